@@ -12,6 +12,7 @@ type Config struct {
 	Env string `toml:"env" `
 	App appConfig
 	Log logConfig
+	Websocket websocketConfig
 }
 
 // AppConfig struct
@@ -21,6 +22,72 @@ type appConfig struct {
 	Debug          int    `toml:"debug" `
 }
 
+// websocket链接配置
+type websocketConfig struct {
+	SendBufferSize     int    `toml:"send_buffer_size"`     // 每个链接的发送缓冲区大小
+	SlowConsumerPolicy string `toml:"slow_consumer_policy"` // 缓冲区满时的处理策略: drop_oldest, drop_newest, disconnect
+	WriteWait          int    `toml:"write_wait"`           // 写消息超时时间(s)
+	PingInterval       int    `toml:"ping_interval"`        // 发送ping的间隔时间(s)
+	PongWait           int    `toml:"pong_wait"`            // 等待pong的超时时间(s)，超时视为断开链接
+
+	SendBufferHighSize int `toml:"send_buffer_high_size"` // 高优先级消息的发送缓冲区大小
+	SendBufferLowSize  int `toml:"send_buffer_low_size"`  // 低优先级消息的发送缓冲区大小
+
+	AllowedOrigins       []string `toml:"allowed_origins"`       // 允许握手的Origin，支持通配符，为空时只允许同源
+	ReadBufferSize       int      `toml:"read_buffer_size"`      // 读缓冲区大小(byte)
+	WriteBufferSize      int      `toml:"write_buffer_size"`     // 写缓冲区大小(byte)
+	MaxMessageSize       int64    `toml:"max_message_size"`      // 客户端单条消息最大长度(byte)
+	HandshakeTimeout     int      `toml:"handshake_timeout"`     // 握手超时时间(s)
+	EnableCompression    bool     `toml:"enable_compression"`    // 是否开启permessage-deflate压缩
+	CompressionThreshold int      `toml:"compression_threshold"` // 消息长度达到该值(byte)才压缩
+
+	ResumeGrace int `toml:"resume_grace"` // 断线重连的宽限时间(s)，期间可接管旧链接未确认的消息
+
+	LoginPolicy string `toml:"login_policy"` // 登录策略: unlimited, max_sessions, per_platform, exclusive
+	MaxSessions int    `toml:"max_sessions"` // max_sessions策略下每个用户最多的链接数
+	LoginEvict  string `toml:"login_evict"`  // 超出限制时: oldest 踢出最早的链接, reject 拒绝新链接
+
+	NodeHeartbeat     int `toml:"node_heartbeat"`      // 服务实例续期存活标记的间隔(s)
+	NodeTTL           int `toml:"node_ttl"`            // 服务实例存活标记的过期时间(s)，过期后链接由其他实例回收
+	NodeSweepInterval int `toml:"node_sweep_interval"` // 检查宕机实例的间隔(s)
+
+	DrainTimeout     int `toml:"drain_timeout"`      // 服务下线时推送缓冲区消息的最长时间(s)
+	DrainRetryJitter int `toml:"drain_retry_jitter"` // 下线时通知客户端重连的随机等待时间上限(ms)
+
+	DispatchWorkers int `toml:"dispatch_workers"` // 每个实例推送消息的协程数，同一用户的消息由同一协程按顺序推送
+
+	InboxBackend      string `toml:"inbox_backend"`        // 用户消息队列的存储方式，list或stream
+	InboxStreamMaxLen int    `toml:"inbox_stream_max_len"` // 使用stream存储时每个用户的最大消息总数，超出时按queue_full_policy处理
+
+	MsgLogSize int `toml:"msg_log_size"` // 每个用户保留的最近消息数，用于客户端按序号补齐
+	MsgLogTTL  int `toml:"msg_log_ttl"`  // 消息记录的过期时间(s)
+
+	OfflineMaxSize int `toml:"offline_max_size"` // 每个用户保留的最大离线消息数
+	OfflineTTL     int `toml:"offline_ttl"`      // 离线消息的过期时间(s)，每次写入时续期
+
+	RetryBackoff     string  `toml:"retry_backoff"`      // 默认重试策略，fixed或exponential
+	RetryInterval    int     `toml:"retry_interval"`     // 首次重试间隔(s)
+	RetryMultiplier  float64 `toml:"retry_multiplier"`   // 指数增长的倍数
+	RetryMaxInterval int     `toml:"retry_max_interval"` // 最大重试间隔(s)
+	RetryJitter      float64 `toml:"retry_jitter"`       // 重试间隔的随机抖动比例，0到1
+	DeadLetterTTL    int     `toml:"dead_letter_ttl"`    // 死信消息的过期时间(s)，每次写入时续期
+
+	MsgStatusTTL   int    `toml:"msg_status_ttl"`  // 消息推送状态的保存时间(s)
+	ReceiptWebhook string `toml:"receipt_webhook"` // 已读回执的回调地址，为空时不回调
+
+	CallbackHosts   []string `toml:"callback_hosts"`   // 发送消息时允许指定的回调地址域名，为空时不允许指定回调地址
+	CallbackTimeout int      `toml:"callback_timeout"` // 回调请求的超时时间(s)
+
+	BulkSyncLimit int `toml:"bulk_sync_limit"` // 批量推送同步返回结果的最大用户数，超过时创建异步任务
+
+	IdempotencyWindow int `toml:"idempotency_window"` // 相同幂等key的发送请求去重的时间窗口(s)
+
+	PriorityBurst int `toml:"priority_burst"` // 高优先级消息连续推送的最大条数，达到后推送一条低优先级消息
+
+	QueueMaxSize    int    `toml:"queue_max_size"`    // 每个用户所有优先级队列的最大消息总数，0为不限制
+	QueueFullPolicy string `toml:"queue_full_policy"` // 队列已满时的处理策略: drop_oldest, reject
+}
+
 type logConfig struct {
 	Path      string
 	AccessLog string `toml:"access_log"`
@@ -47,5 +114,131 @@ func Init(path string) (*Config, error) {
 	if _, err := toml.DecodeFile(filePath, &Settings); err != nil {
 		panic(err)
 	}
+	Settings.setDefaults()
 	return Settings, nil
 }
+
+// 未配置的项使用默认值
+func (c *Config) setDefaults() {
+	if c.Websocket.SendBufferSize <= 0 {
+		c.Websocket.SendBufferSize = 1000
+	}
+	if c.Websocket.SendBufferHighSize <= 0 {
+		c.Websocket.SendBufferHighSize = 100
+	}
+	if c.Websocket.SendBufferLowSize <= 0 {
+		c.Websocket.SendBufferLowSize = 100
+	}
+	if c.Websocket.SlowConsumerPolicy == "" {
+		c.Websocket.SlowConsumerPolicy = "drop_oldest"
+	}
+	if c.Websocket.WriteWait <= 0 {
+		c.Websocket.WriteWait = 10
+	}
+	if c.Websocket.PongWait <= 0 {
+		c.Websocket.PongWait = 60
+	}
+	if c.Websocket.ReadBufferSize <= 0 {
+		c.Websocket.ReadBufferSize = 1024
+	}
+	if c.Websocket.WriteBufferSize <= 0 {
+		c.Websocket.WriteBufferSize = 1024
+	}
+	if c.Websocket.MaxMessageSize <= 0 {
+		c.Websocket.MaxMessageSize = 65536
+	}
+	if c.Websocket.HandshakeTimeout <= 0 {
+		c.Websocket.HandshakeTimeout = 5
+	}
+	if c.Websocket.ResumeGrace <= 0 {
+		c.Websocket.ResumeGrace = 60
+	}
+	if c.Websocket.LoginPolicy == "" {
+		c.Websocket.LoginPolicy = "unlimited"
+	}
+	if c.Websocket.MaxSessions <= 0 {
+		c.Websocket.MaxSessions = 5
+	}
+	if c.Websocket.LoginEvict == "" {
+		c.Websocket.LoginEvict = "oldest"
+	}
+	if c.Websocket.NodeHeartbeat <= 0 {
+		c.Websocket.NodeHeartbeat = 10
+	}
+	if c.Websocket.NodeTTL <= c.Websocket.NodeHeartbeat {
+		c.Websocket.NodeTTL = c.Websocket.NodeHeartbeat * 3
+	}
+	if c.Websocket.NodeSweepInterval <= 0 {
+		c.Websocket.NodeSweepInterval = 30
+	}
+	if c.Websocket.QueueMaxSize < 0 {
+		c.Websocket.QueueMaxSize = 0
+	}
+	if c.Websocket.QueueFullPolicy == "" {
+		c.Websocket.QueueFullPolicy = "drop_oldest"
+	}
+	if c.Websocket.PriorityBurst <= 0 {
+		c.Websocket.PriorityBurst = 10
+	}
+	if c.Websocket.IdempotencyWindow <= 0 {
+		c.Websocket.IdempotencyWindow = 86400
+	}
+	if c.Websocket.BulkSyncLimit <= 0 {
+		c.Websocket.BulkSyncLimit = 1000
+	}
+	if c.Websocket.MsgStatusTTL <= 0 {
+		c.Websocket.MsgStatusTTL = 3 * 86400
+	}
+	if c.Websocket.RetryBackoff == "" {
+		c.Websocket.RetryBackoff = "fixed"
+	}
+	if c.Websocket.RetryInterval <= 0 {
+		c.Websocket.RetryInterval = 3
+	}
+	if c.Websocket.RetryMultiplier <= 1 {
+		c.Websocket.RetryMultiplier = 2
+	}
+	if c.Websocket.RetryMaxInterval <= 0 {
+		c.Websocket.RetryMaxInterval = 60
+	}
+	if c.Websocket.RetryJitter < 0 || c.Websocket.RetryJitter > 1 {
+		c.Websocket.RetryJitter = 0
+	}
+	if c.Websocket.CallbackTimeout <= 0 {
+		c.Websocket.CallbackTimeout = 5
+	}
+	if c.Websocket.DeadLetterTTL <= 0 {
+		c.Websocket.DeadLetterTTL = 7 * 86400
+	}
+	if c.Websocket.OfflineMaxSize <= 0 {
+		c.Websocket.OfflineMaxSize = 1000
+	}
+	if c.Websocket.OfflineTTL <= 0 {
+		c.Websocket.OfflineTTL = 7 * 86400
+	}
+	if c.Websocket.MsgLogSize <= 0 {
+		c.Websocket.MsgLogSize = 1000
+	}
+	if c.Websocket.MsgLogTTL <= 0 {
+		c.Websocket.MsgLogTTL = 7 * 86400
+	}
+	if c.Websocket.InboxBackend == "" {
+		c.Websocket.InboxBackend = "list"
+	}
+	if c.Websocket.InboxStreamMaxLen <= 0 {
+		c.Websocket.InboxStreamMaxLen = 10000
+	}
+	if c.Websocket.DispatchWorkers <= 0 {
+		c.Websocket.DispatchWorkers = 16
+	}
+	if c.Websocket.DrainTimeout <= 0 {
+		c.Websocket.DrainTimeout = 10
+	}
+	if c.Websocket.DrainRetryJitter < 0 {
+		c.Websocket.DrainRetryJitter = 0
+	}
+	// ping间隔必须小于pong超时时间
+	if c.Websocket.PingInterval <= 0 || c.Websocket.PingInterval >= c.Websocket.PongWait {
+		c.Websocket.PingInterval = c.Websocket.PongWait * 9 / 10
+	}
+}
@@ -24,6 +24,7 @@ require (
 	github.com/jessevdk/go-flags v1.4.0 // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/uber/go-torch v0.0.0-20181107071353-86f327cc820e // indirect
+	github.com/ugorji/go/codec v1.1.7
 	go.uber.org/zap v1.15.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
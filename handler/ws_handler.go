@@ -2,12 +2,9 @@ package handler
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"go-ws/config"
 	"go-ws/services/wsservice"
-	"go-ws/utils"
 	"go-ws/utils/errs"
 	"go-ws/utils/logger"
 	"go-ws/utils/ws"
@@ -18,45 +15,119 @@ import (
 	"time"
 )
 
-// 建立链接
+// 建立链接，断线重连时携带上次握手返回的resume_token和最后收到的消息序号last_seq
 func WsConnectionHandler(c *gin.Context) {
 	uid, ok := strconv.Atoi(c.Query("uid"))
 	if ok != nil || uid == 0  {
 		c.Error(errs.ErrParam)
+		return
+	}
+	// 服务下线中不再接受新链接
+	if wsservice.IsDraining() {
+		c.Error(errs.ErrWebSocketServerDraining)
+		return
 	}
 
-	conn, err := ws.CreateWsConnection(c.Writer, c.Request)
+	var err error
+	var prevConn *wsservice.WsUserConnInfo
+	if resumeToken := c.Query("resume_token"); resumeToken != "" {
+		// 重连失败时按新链接处理
+		prevConn, err = wsservice.GetResumableUserConn(uid, resumeToken)
+		if err != nil {
+			logger.Logger.Warn("resume websocket connect failed", zap.Int("uid", uid), zap.Error(err))
+			prevConn = nil
+		}
+	}
+
+	var connId string
+	if prevConn != nil {
+		connId = prevConn.ID
+	} else if err = wsservice.CheckLoginPolicy(uid, strings.ToLower(c.Query("platform"))); err != nil {
+		c.Error(err)
+		return
+	}
+	newResumeToken := wsservice.NewResumeToken()
+	conn, err := ws.CreateWsConnection(c.Writer, c.Request, connId, http.Header{"resume_token": {newResumeToken}})
 	if err != nil {
 		logger.Logger.Warn("create websocket connect failed", zap.Int("uid", uid), zap.Error(err))
 		c.Error(err)
 		return
 	}
 
-	ip, _ := utils.GetLocalIP()
-	port := strings.Split(config.Settings.App.Bind, ":")[1]
-
-	wsUserConn := wsservice.AddWsUserConnInfo(uid, ip + ":" + port, &conn)
+	wsUserConn := wsservice.NewWsUserConnInfo(uid, wsservice.LocalNode(), &conn)
+	wsUserConn.ResumeToken = newResumeToken
+	// 握手时上报的设备信息
+	wsUserConn.DeviceId = c.Query("device_id")
+	wsUserConn.Platform = strings.ToLower(c.Query("platform"))
+	wsUserConn.AppVersion = c.Query("app_version")
+	wsUserConn.Locale = c.Query("locale")
+	wsUserConn.UserAgent = c.Query("user_agent")
+	if wsUserConn.UserAgent == "" {
+		wsUserConn.UserAgent = c.Request.UserAgent()
+	}
+	if prevConn != nil {
+		lastSeq, _ := strconv.ParseInt(c.Query("last_seq"), 10, 64)
+		wsUserConn.Resume(prevConn, lastSeq)
+	}
+	// 第一条消息下发链接ID和重连token，浏览器无法读取握手响应头
+	_ = wsUserConn.SendSessionInfo(prevConn != nil)
+	wsUserConn.Register()
 
-	// 检测心跳
-	go wsUserConn.HeartBeatCheck()
-	// 循环推送消息
-	go wsUserConn.PushLoop()
+	// 写协程，统一推送发送缓冲区的消息并定时ping
+	go wsUserConn.WritePump()
 	// 循环接收消息，保存ACK
 	go wsUserConn.ReceiveLoop()
 
 }
 
-// 关闭链接
+// 获取用户ID，未启用登录中间件时(如服务间调用)从参数中读取
+func getUid(c *gin.Context) int {
+	if v, ok := c.Get("uid"); ok {
+		switch uid := v.(type) {
+		case int:
+			return uid
+		case int32:
+			return int(uid)
+		}
+	}
+	uid, _ := strconv.Atoi(c.Request.FormValue("uid"))
+	return uid
+}
+
+// 获取关闭原因，未指定时默认为管理员踢出
+func getCloseReason(c *gin.Context) (errs.CloseReason, error) {
+	code := c.PostForm("code")
+	if code == "" {
+		return errs.CloseKickedByAdmin, nil
+	}
+	reasonCode, err := strconv.Atoi(code)
+	if err != nil {
+		return errs.CloseReason{}, errs.ErrParam
+	}
+	reason, ok := errs.GetCloseReason(reasonCode)
+	if !ok {
+		return errs.CloseReason{}, errs.ErrWebSocketCloseCodeInvalid
+	}
+	return reason, nil
+}
+
+// 关闭链接，可通过code指定发送给客户端的关闭原因
 func CloseWsHandler(c *gin.Context) {
-	uid, ok := c.MustGet("uid").(int)
-	if !ok || uid == 0  {
+	uid := getUid(c)
+	if uid == 0  {
 		c.Error(errs.ErrParam)
+		return
 	}
 	connId := c.PostForm("cid")
 	if connId == "" {
 		c.Error(errs.ErrWebSocketConnectionIDIsNil)
 		return
 	}
+	reason, err := getCloseReason(c)
+	if err != nil {
+		c.Error(err)
+		return
+	}
 
 	wsConn, err := wsservice.GetWsUserConnInfo(connId)
 	if err != nil {
@@ -65,11 +136,7 @@ func CloseWsHandler(c *gin.Context) {
 		return
 	}
 
-	if wsConn.Node == c.Request.Host {
-		err = wsservice.DelLocalUserConn(connId)
-	} else {
-		err = wsservice.DelOtherServerUserConn(wsConn.Node, connId)
-	}
+	err = wsservice.CloseUserConn(wsConn, reason)
 	if err != nil {
 		logger.Logger.Warn("delete websocket connection failed", zap.Int("uid", uid), zap.String("user_conn_id", connId), zap.Error(err))
 		c.Error(err)
@@ -79,7 +146,7 @@ func CloseWsHandler(c *gin.Context) {
 	wsConn.Closed = true
 	wsConn.DisConnectTime = time.Now().Unix()
 	// 更新链接状态
-	err = wsConn.UpdateUserInfo()
+	_, err = wsConn.UpdateClosedUserInfo()
 	if err != nil {
 		c.Error(err)
 		return
@@ -93,13 +160,19 @@ func CloseWsHandler(c *gin.Context) {
 
 // 关闭某个用户的所有链接
 func CloseAllConnHandler(c *gin.Context) {
-	uid, ok := c.MustGet("uid").(int)
-	if !ok || uid == 0  {
+	uid := getUid(c)
+	if uid == 0  {
 		c.Error(errs.ErrParam)
+		return
+	}
+	reason, err := getCloseReason(c)
+	if err != nil {
+		c.Error(err)
+		return
 	}
 
-	var userConnList []wsservice.WsUserConnInfo
-	userConnList, err := wsservice.GetAllUserInfoList(uid)
+	var userConnList []*wsservice.WsUserConnInfo
+	userConnList, err = wsservice.GetAllUserInfoList(uid)
 	if err != nil {
 		logger.Logger.Warn("get user conn list failed", zap.Int("uid", uid), zap.Error(err))
 		return
@@ -107,12 +180,7 @@ func CloseAllConnHandler(c *gin.Context) {
 
 	for _, userConn := range userConnList {
 		if !userConn.Closed {
-			if userConn.Node == c.Request.Host {
-				err = wsservice.DelLocalUserConn(userConn.ID)
-			} else {
-				err = wsservice.DelOtherServerUserConn(userConn.Node, userConn.ID)
-			}
-
+			err = wsservice.CloseUserConn(userConn, reason)
 			if err != nil {
 				logger.Logger.Warn("delete websocket connection failed", zap.Int("uid", uid), zap.String("user_conn_id", userConn.ID), zap.Error(err))
 				continue
@@ -127,38 +195,222 @@ func CloseAllConnHandler(c *gin.Context) {
 	})
 }
 
-type PushMsgReq struct {
-	Uid int `json:"uid" form:"uid" binding:"required"`
+// 查询用户的链接及设备信息，可按设备信息筛选，online=1时只返回在线的链接
+func GetUserConnListHandler(c *gin.Context) {
+	uid := getUid(c)
+	if uid == 0  {
+		c.Error(errs.ErrParam)
+		return
+	}
+	var filter wsservice.ConnFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.Error(errs.ErrParam)
+		return
+	}
+	onlineOnly := c.Query("online") == "1"
+
+	userConnList, err := wsservice.GetAllUserInfoList(uid)
+	if err != nil {
+		logger.Logger.Warn("get user conn list failed", zap.Int("uid", uid), zap.Error(err))
+		c.Error(err)
+		return
+	}
+
+	var result = make([]*wsservice.WsUserConnInfo, 0, len(userConnList))
+	for _, userConn := range userConnList {
+		if onlineOnly && userConn.Closed {
+			continue
+		}
+		if filter.Match(userConn) {
+			result = append(result, userConn)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"msg":  "success",
+		"result": result,
+	})
+}
+
+// 消息内容及推送选项
+type MsgReq struct {
 	Content string `json:"content" form:"content" binding:"required"`
 	Retries int `json:"retries" form:"retries" binding:"required"` // 重试次数
+	Include *wsservice.ConnFilter `json:"include" form:"-"` // 只推送给满足条件的链接，如只推送ios设备，只支持json，表单使用conn_id、device_id、platform
+	Exclude *wsservice.ConnFilter `json:"exclude" form:"-"` // 不推送给满足条件的链接，如不推送web端，只支持json
+	Backoff *wsservice.BackoffPolicy `json:"backoff"` // 重试策略，为空时使用默认策略
+	CallbackUrl string `json:"callback_url" form:"callback_url"` // 消息状态变更的回调地址
+	From int `json:"from" form:"from"` // 发送者的用户ID，已读回执推送给发送者
+	ExpiresAt int64 `json:"expires_at" form:"expires_at"` // 过期时间戳，与ttl同时设置时以较早的为准
+	Ttl int64 `json:"ttl" form:"ttl"` // 有效时长(s)
+	CollapseKey string `json:"collapse_key" form:"collapse_key"` // 合并key，如角标数、比分等只推送最新的一条
+	DeliverAt int64 `json:"deliver_at" form:"deliver_at"` // 定时推送的时间戳，为空或已过时立即推送
+	ConnId string `json:"conn_id" form:"conn_id"` // 只推送给指定的链接
+	DeviceId string `json:"device_id" form:"device_id"` // 只推送给指定的设备，如只在新设备上显示登录验证
+	Platform string `json:"platform" form:"platform"` // 只推送给指定的平台
+	OriginConnId string `json:"origin_conn_id" form:"origin_conn_id"` // 发起操作的链接，推送给除该链接外的所有链接
+	Priority int `json:"priority" form:"priority"` // 优先级，1为高，如强制下线、支付确认，-1为低，默认为普通
+}
+
+// 合并单个链接、设备、平台的推送目标到筛选条件中，不修改请求中的筛选条件
+func (msgReq MsgReq) connFilter() (include *wsservice.ConnFilter) {
+	include = msgReq.Include
+	if msgReq.ConnId != "" || msgReq.DeviceId != "" || msgReq.Platform != "" {
+		filter := wsservice.ConnFilter{}
+		if include != nil {
+			filter = *include
+		}
+		if msgReq.ConnId != "" {
+			filter.ConnIds = []string{msgReq.ConnId}
+		}
+		if msgReq.DeviceId != "" {
+			filter.DeviceIds = []string{msgReq.DeviceId}
+		}
+		if msgReq.Platform != "" {
+			filter.Platforms = []string{msgReq.Platform}
+		}
+		include = &filter
+	}
+	return
+}
+
+type PushMsgReq struct {
+	Uid int `json:"uid" form:"uid" binding:"required,gt=0"`
+	Id string `json:"id" form:"id"` // 客户端指定的消息ID，同时作为幂等key，按用户区分，实际的消息ID为uid:id
+	IdempotencyKey string `json:"idempotency_key" form:"idempotency_key"` // 幂等key，也可通过Idempotency-Key请求头指定
+	MsgReq
 }
 
-// 接收信息保存到消息队列
+// 根据请求生成消息
+func (msgReq MsgReq) newMsg(uid int) wsservice.Msg {
+	msg := wsservice.Msg{
+		ID:           wsservice.NewMsgId(),
+		UID:          uid,
+		Content:      msgReq.Content,
+		Retries:      msgReq.Retries,
+		Include:      msgReq.connFilter(),
+		Exclude:      msgReq.Exclude,
+		OriginConnId: msgReq.OriginConnId,
+		Backoff:      msgReq.Backoff,
+		From:         msgReq.From,
+		ExpiresAt:    msgReq.ExpiresAt,
+		CollapseKey:  msgReq.CollapseKey,
+		Priority:     msgReq.Priority,
+	}
+	msg.SetTtl(time.Now().Unix(), msgReq.Ttl)
+	return msg
+}
+
+// 根据请求生成定时推送，有效时长从每次推送的时间开始计算
+func (msgReq MsgReq) newMsgSchedule(msg wsservice.Msg, cron string) wsservice.MsgSchedule {
+	msg.ExpiresAt = msgReq.ExpiresAt
+	return wsservice.MsgSchedule{
+		Msg:         msg,
+		Cron:        cron,
+		DeliverAt:   msgReq.DeliverAt,
+		Ttl:         msgReq.Ttl,
+		CallbackUrl: msgReq.CallbackUrl,
+	}
+}
+
+// 接收信息保存到消息队列，指定deliver_at时定时推送
 func SendMessageHandler(c *gin.Context) {
 	var msgReq PushMsgReq
 	if err := c.ShouldBind(&msgReq); err != nil {
 		c.Error(err)
 		return
 	}
+	if len(msgReq.Id) > 128 {
+		c.Error(errs.ErrParam)
+		return
+	}
+	if err := wsservice.CheckCallbackUrl(msgReq.CallbackUrl); err != nil {
+		c.Error(err)
+		return
+	}
 
-	msg := wsservice.Msg{
-		ID:      fmt.Sprintf("%d-%s", time.Now().Unix(), uuid.New().String()),
-		UID:     msgReq.Uid,
-		Content: msgReq.Content,
-		Retries: msgReq.Retries,
+	// 幂等key未指定时使用客户端指定的消息ID，窗口时间内的重复请求直接返回首次发送的结果
+	idempotencyKey := msgReq.IdempotencyKey
+	if idempotencyKey == "" {
+		idempotencyKey = c.GetHeader("Idempotency-Key")
+	}
+	if idempotencyKey == "" {
+		idempotencyKey = msgReq.Id
+	}
+	if idempotencyKey != "" {
+		prev, reserved, err := wsservice.ReserveIdempotencyKey(msgReq.Uid, idempotencyKey)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if !reserved {
+			var result sendMsgResult
+			_ = json.Unmarshal(prev, &result)
+			c.JSON(http.StatusOK, gin.H{
+				"code":   0,
+				"msg":    "success",
+				"result": result,
+			})
+			return
+		}
 	}
 
-	err := msg.PushWsMsgToQueue()
+	result, err := sendMsg(msgReq)
+	if idempotencyKey != "" {
+		if err != nil {
+			wsservice.ReleaseIdempotencyKey(msgReq.Uid, idempotencyKey)
+		} else {
+			data, _ := json.Marshal(result)
+			// 结果保存失败时释放，避免重复请求一直等待到幂等窗口结束
+			if wsservice.SaveIdempotencyResult(msgReq.Uid, idempotencyKey, data) != nil {
+				wsservice.ReleaseIdempotencyKey(msgReq.Uid, idempotencyKey)
+			}
+		}
+	}
 	if err != nil {
-		c.Error(errs.ErrPushMsgToQueueFailed)
+		c.Error(err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"code": 0,
-		"msg":  "success",
+		"code":   0,
+		"msg":    "success",
+		"result": result,
 	})
+}
 
+// 发送结果
+type sendMsgResult struct {
+	ID         string `json:"id"`
+	Seq        int64  `json:"seq,omitempty"`
+	ScheduleId string `json:"schedule_id,omitempty"`
+}
+
+// 消息写入用户的消息队列，指定deliver_at时定时推送
+func sendMsg(msgReq PushMsgReq) (result sendMsgResult, err error) {
+	msg := msgReq.newMsg(msgReq.Uid)
+	if msgReq.Id != "" {
+		// 消息状态、撤回等按消息ID全局查找，加上用户ID避免不同用户指定相同的ID互相覆盖
+		msg.ID = strconv.Itoa(msgReq.Uid) + ":" + msgReq.Id
+	}
+	if msgReq.DeliverAt > time.Now().Unix() {
+		schedule := msgReq.newMsgSchedule(msg, "")
+		if err = wsservice.AddMsgSchedule(&schedule); err != nil {
+			return
+		}
+		return sendMsgResult{ID: msg.ID, ScheduleId: schedule.ID}, nil
+	}
+
+	// 先记录状态，避免消息分发时状态还未创建
+	_ = msg.InitMsgStatus(msgReq.CallbackUrl)
+	if err = msg.PushWsMsgToQueue(); err != nil {
+		if err == errs.ErrMsgQueueFull {
+			return
+		}
+		return result, errs.ErrPushMsgToQueueFailed
+	}
+	return sendMsgResult{ID: msg.ID, Seq: msg.Seq}, nil
 }
 
 type RecMsgReq struct {
@@ -191,4 +443,492 @@ func PushMsgToUserConn(c *gin.Context) {
 		"code": 0,
 		"msg":  "success",
 	})
-}
\ No newline at end of file
+}
+
+// 分页获取离线消息，from_seq为上一页最后一条消息的序号
+func GetOfflineMsgHandler(c *gin.Context) {
+	uid := getUid(c)
+	if uid == 0 {
+		c.Error(errs.ErrParam)
+		return
+	}
+	fromSeq, _ := strconv.ParseInt(c.Query("from_seq"), 10, 64)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	msgs, hasMore, err := wsservice.GetOfflineMsgList(uid, fromSeq, limit)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	nextSeq := fromSeq
+	if len(msgs) > 0 {
+		nextSeq = msgs[len(msgs)-1].Seq
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"msg":  "success",
+		"result": gin.H{
+			"list":     msgs,
+			"has_more": hasMore,
+			"next_seq": nextSeq,
+		},
+	})
+}
+
+// 获取用户的死信消息列表
+func GetDeadLetterListHandler(c *gin.Context) {
+	uid := getUid(c)
+	if uid == 0 {
+		c.Error(errs.ErrParam)
+		return
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	list, total, err := wsservice.GetDeadLetterList(uid, offset, limit)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"msg":  "success",
+		"result": gin.H{
+			"list":  list,
+			"total": total,
+		},
+	})
+}
+
+// 查看某条死信消息
+func GetDeadLetterHandler(c *gin.Context) {
+	uid := getUid(c)
+	msgId := c.Query("id")
+	if uid == 0 || msgId == "" {
+		c.Error(errs.ErrParam)
+		return
+	}
+
+	deadLetter, err := wsservice.GetDeadLetter(uid, msgId)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": deadLetter,
+	})
+}
+
+// 获取请求中的消息ID列表，多个ID用逗号分隔，为空表示全部
+func getMsgIds(c *gin.Context) (msgIds []string) {
+	for _, id := range strings.Split(c.PostForm("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			msgIds = append(msgIds, id)
+		}
+	}
+	return
+}
+
+// 重新推送死信消息
+func ReplayDeadLetterHandler(c *gin.Context) {
+	uid := getUid(c)
+	if uid == 0 {
+		c.Error(errs.ErrParam)
+		return
+	}
+
+	count, err := wsservice.ReplayDeadLetter(uid, getMsgIds(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": gin.H{"count": count},
+	})
+}
+
+// 删除死信消息
+func PurgeDeadLetterHandler(c *gin.Context) {
+	uid := getUid(c)
+	if uid == 0 {
+		c.Error(errs.ErrParam)
+		return
+	}
+
+	count, err := wsservice.PurgeDeadLetter(uid, getMsgIds(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": gin.H{"count": count},
+	})
+}
+
+// 查询消息的推送状态
+func GetMsgStatusHandler(c *gin.Context) {
+	msgId := c.Param("id")
+	if msgId == "" {
+		c.Error(errs.ErrParam)
+		return
+	}
+
+	status, err := wsservice.GetMsgStatus(msgId)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": status,
+	})
+}
+
+type ScheduleMsgReq struct {
+	PushMsgReq
+	Cron string `json:"cron" form:"cron"` // 周期推送的cron表达式：分 时 日 月 周，与deliver_at至少指定一个
+}
+
+// 添加定时推送，指定cron时周期推送
+func AddMsgScheduleHandler(c *gin.Context) {
+	var msgReq ScheduleMsgReq
+	if err := c.ShouldBind(&msgReq); err != nil {
+		c.Error(err)
+		return
+	}
+	if msgReq.Cron == "" && msgReq.DeliverAt <= time.Now().Unix() {
+		c.Error(errs.ErrMsgScheduleInvalid)
+		return
+	}
+	if err := wsservice.CheckCallbackUrl(msgReq.CallbackUrl); err != nil {
+		c.Error(err)
+		return
+	}
+
+	schedule := msgReq.newMsgSchedule(msgReq.newMsg(msgReq.Uid), msgReq.Cron)
+	if err := wsservice.AddMsgSchedule(&schedule); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": schedule,
+	})
+}
+
+// 获取定时推送列表，uid为空时返回全部
+func GetMsgScheduleListHandler(c *gin.Context) {
+	list, err := wsservice.GetMsgScheduleList(getUid(c))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": list,
+	})
+}
+
+type UpdateScheduleReq struct {
+	ID        string `json:"id" form:"id" binding:"required"`
+	Content   string `json:"content" form:"content"`
+	Cron      string `json:"cron" form:"cron"`
+	DeliverAt int64  `json:"deliver_at" form:"deliver_at"`
+}
+
+// 更新定时推送的内容或时间，指定deliver_at时改为一次性推送
+func UpdateMsgScheduleHandler(c *gin.Context) {
+	var req UpdateScheduleReq
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err)
+		return
+	}
+
+	schedule, err := wsservice.GetMsgSchedule(req.ID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	if req.Content != "" {
+		schedule.Msg.Content = req.Content
+	}
+	if req.Cron != "" {
+		schedule.Cron = req.Cron
+	} else if req.DeliverAt > 0 {
+		schedule.Cron = ""
+		schedule.DeliverAt = req.DeliverAt
+	}
+
+	if err = wsservice.UpdateMsgSchedule(&schedule); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": schedule,
+	})
+}
+
+// 取消定时推送
+func CancelMsgScheduleHandler(c *gin.Context) {
+	id := c.PostForm("id")
+	if id == "" {
+		c.Error(errs.ErrParam)
+		return
+	}
+
+	if err := wsservice.CancelMsgSchedule(id); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"msg":  "success",
+	})
+}
+
+type BulkMsgReq struct {
+	Uids    []int              `json:"uids" form:"uids"`
+	Segment *wsservice.Segment `json:"segment"` // 按用户标签和链接信息筛选，与uids同时设置时合并推送
+	MsgReq
+}
+
+// 批量推送，用户数不超过bulk_sync_limit且没有筛选条件时直接返回每个用户的写入结果，否则返回任务ID
+// 不支持定时推送和幂等key
+func BulkSendMessageHandler(c *gin.Context) {
+	var msgReq BulkMsgReq
+	if err := c.ShouldBind(&msgReq); err != nil {
+		c.Error(err)
+		return
+	}
+	if len(msgReq.Uids) == 0 && msgReq.Segment.IsEmpty() {
+		c.Error(errs.ErrParam)
+		return
+	}
+	for _, uid := range msgReq.Uids {
+		if uid <= 0 {
+			c.Error(errs.ErrParam)
+			return
+		}
+	}
+	if msgReq.DeliverAt > time.Now().Unix() || c.GetHeader("Idempotency-Key") != "" {
+		c.Error(errs.ErrParam)
+		return
+	}
+	if err := wsservice.CheckCallbackUrl(msgReq.CallbackUrl); err != nil {
+		c.Error(err)
+		return
+	}
+
+	msg := msgReq.newMsg(0)
+	if msgReq.Segment.IsEmpty() && len(msgReq.Uids) <= config.Settings.Websocket.BulkSyncLimit {
+		c.JSON(http.StatusOK, gin.H{
+			"code": 0,
+			"msg":  "success",
+			"result": gin.H{
+				"list": wsservice.SendBulkMsg(msg, msgReq.Uids, msgReq.CallbackUrl),
+			},
+		})
+		return
+	}
+
+	job, err := wsservice.StartBulkJob(msg, msgReq.Uids, msgReq.Segment, msgReq.CallbackUrl)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": job,
+	})
+}
+
+// 查询批量推送任务进度
+func GetBulkJobHandler(c *gin.Context) {
+	job, err := wsservice.GetBulkJob(c.Param("id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": job,
+	})
+}
+
+// 获取请求中的标签列表，多个标签用逗号分隔
+func getTags(c *gin.Context) (tags []string) {
+	for _, tag := range strings.Split(c.Request.FormValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// 给用户添加标签
+func AddUserTagsHandler(c *gin.Context) {
+	uid := getUid(c)
+	tags := getTags(c)
+	if uid == 0 || len(tags) == 0 {
+		c.Error(errs.ErrParam)
+		return
+	}
+
+	if err := wsservice.AddUserTags(uid, tags); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"msg":  "success",
+	})
+}
+
+// 删除用户的标签
+func DelUserTagsHandler(c *gin.Context) {
+	uid := getUid(c)
+	tags := getTags(c)
+	if uid == 0 || len(tags) == 0 {
+		c.Error(errs.ErrParam)
+		return
+	}
+
+	if err := wsservice.DelUserTags(uid, tags); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"msg":  "success",
+	})
+}
+
+// 获取用户的标签
+func GetUserTagsHandler(c *gin.Context) {
+	uid := getUid(c)
+	if uid == 0 {
+		c.Error(errs.ErrParam)
+		return
+	}
+
+	tags, err := wsservice.GetUserTags(uid)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": tags,
+	})
+}
+
+type ReviseMsgReq struct {
+	Uid     int    `json:"uid" form:"uid" binding:"required"`
+	Id      string `json:"id" form:"id" binding:"required"`
+	Content string `json:"content" form:"content"` // 编辑后的内容，撤回时不需要
+}
+
+// 撤回消息，返回消息是从队列中删除还是已向收到的链接推送撤回事件
+func RecallMsgHandler(c *gin.Context) {
+	var req ReviseMsgReq
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err)
+		return
+	}
+
+	result, err := wsservice.RecallMsg(req.Uid, req.Id)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": result,
+	})
+}
+
+// 编辑消息，返回消息是在队列中替换还是已向收到的链接推送编辑事件
+func EditMsgHandler(c *gin.Context) {
+	var req ReviseMsgReq
+	if err := c.ShouldBind(&req); err != nil {
+		c.Error(err)
+		return
+	}
+	if req.Content == "" {
+		c.Error(errs.ErrParam)
+		return
+	}
+
+	result, err := wsservice.EditMsg(req.Uid, req.Id, req.Content)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": result,
+	})
+}
+
+// 查询消息队列长度，指定uid时返回该用户各队列的长度，否则返回所有用户队列的统计
+func GetQueueStatsHandler(c *gin.Context) {
+	var result interface{}
+	var err error
+	if uid := getUid(c); uid > 0 {
+		result, err = wsservice.GetUserQueueStats(uid)
+	} else {
+		result, err = wsservice.GetQueueStats()
+	}
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   0,
+		"msg":    "success",
+		"result": result,
+	})
+}
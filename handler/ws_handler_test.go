@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newBindContext(contentType, body string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/ws/msg/send", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", contentType)
+	return c
+}
+
+// 表单中的设备筛选字段不能同时绑定到include和exclude
+func TestPushMsgReqFormBinding(t *testing.T) {
+	c := newBindContext("application/x-www-form-urlencoded", "uid=1&content=hello&retries=1&platforms=ios&platform=android")
+	var req PushMsgReq
+	if err := c.ShouldBind(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Include != nil || req.Exclude != nil {
+		t.Fatalf("include and exclude should not bind from form, got include=%+v exclude=%+v", req.Include, req.Exclude)
+	}
+	if req.Platform != "android" {
+		t.Fatalf("platform = %q, want android", req.Platform)
+	}
+
+	msg := req.newMsg(req.Uid)
+	if msg.Include == nil || len(msg.Include.Platforms) != 1 || msg.Include.Platforms[0] != "android" {
+		t.Fatalf("msg include = %+v, want platform android", msg.Include)
+	}
+	if msg.Exclude != nil {
+		t.Fatalf("msg exclude = %+v, want nil", msg.Exclude)
+	}
+}
+
+func TestPushMsgReqJsonBinding(t *testing.T) {
+	c := newBindContext("application/json", `{"uid":1,"content":"hello","retries":1,"include":{"platforms":["ios"]},"exclude":{"device_ids":["d1"]}}`)
+	var req PushMsgReq
+	if err := c.ShouldBind(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Include == nil || len(req.Include.Platforms) != 1 || req.Include.Platforms[0] != "ios" {
+		t.Fatalf("include = %+v, want platform ios", req.Include)
+	}
+	if req.Exclude == nil || len(req.Exclude.Platforms) != 0 || len(req.Exclude.DeviceIds) != 1 {
+		t.Fatalf("exclude = %+v, want device d1 only", req.Exclude)
+	}
+}
+
+func TestBulkMsgReqFormBinding(t *testing.T) {
+	c := newBindContext("application/x-www-form-urlencoded", "uids=1&uids=2&content=hello&retries=1&tags=vip&platforms=ios")
+	var req BulkMsgReq
+	if err := c.ShouldBind(&req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Uids) != 2 {
+		t.Fatalf("uids = %v, want 2 uids", req.Uids)
+	}
+	if req.Segment == nil || len(req.Segment.Tags) != 1 || req.Segment.Tags[0] != "vip" {
+		t.Fatalf("segment = %+v, want tag vip", req.Segment)
+	}
+	if req.Segment.Conn != nil || req.Include != nil || req.Exclude != nil {
+		t.Fatalf("conn filters should not bind from form, got segment.conn=%+v include=%+v exclude=%+v", req.Segment.Conn, req.Include, req.Exclude)
+	}
+}
+
+// 用户ID必须为正数，负数的用户ID会写入待分发列表
+func TestPushMsgReqUidBinding(t *testing.T) {
+	for _, body := range []string{"uid=-1&content=hello&retries=1", "uid=0&content=hello&retries=1"} {
+		c := newBindContext("application/x-www-form-urlencoded", body)
+		var req PushMsgReq
+		if err := c.ShouldBind(&req); err == nil {
+			t.Errorf("bind %q should fail", body)
+		}
+	}
+}
@@ -40,11 +40,13 @@ func main() {
 		Handler: routers,
 	}
 
-	// gracehttp可平滑重启
+	// gracehttp可平滑重启，websocket链接被hijack后不受http.Server管理，退出前单独下线
 	if err := gracehttp.Serve(srv); err != nil {
 		logger.Logger.Info("Start Server failed", zap.Error(err))
+		wsservice.Drain()
 		return
 	}
+	wsservice.Drain()
 
 	defer func(srv *http.Server) {
 		err := recover()
@@ -15,12 +15,52 @@ func Router(router *gin.Engine) *gin.Engine {
 		// 关闭用户链接
 		wsRouter.POST("connection/close", handler.CloseWsHandler)
 
+		// 关闭某个用户的所有链接
+		wsRouter.POST("connection/close_all", handler.CloseAllConnHandler)
+
+		// 查询用户的链接及设备信息
+		wsRouter.GET("connection/list", handler.GetUserConnListHandler)
+
 		// 推送消息给某个用户链接，用于服务间推送
 		wsRouter.POST("msg/push", handler.PushMsgToUserConn)
 
 		// 接收信息保存到消息队列
 		wsRouter.POST("msg/send", handler.SendMessageHandler)
 
+		// 分页获取离线消息
+		wsRouter.GET("msg/offline", handler.GetOfflineMsgHandler)
+
+		// 查询消息的推送状态
+		wsRouter.GET("msg/status/:id", handler.GetMsgStatusHandler)
+
+		// 消息队列长度统计
+		wsRouter.GET("msg/queue/stats", handler.GetQueueStatsHandler)
+
+		// 撤回和编辑已发送的消息
+		wsRouter.POST("msg/recall", handler.RecallMsgHandler)
+		wsRouter.POST("msg/edit", handler.EditMsgHandler)
+
+		// 批量推送及任务进度
+		wsRouter.POST("msg/bulk_send", handler.BulkSendMessageHandler)
+		wsRouter.GET("msg/bulk/:id", handler.GetBulkJobHandler)
+
+		// 用户标签，用于批量推送时筛选用户
+		wsRouter.POST("user/tag/add", handler.AddUserTagsHandler)
+		wsRouter.POST("user/tag/del", handler.DelUserTagsHandler)
+		wsRouter.GET("user/tag/list", handler.GetUserTagsHandler)
+
+		// 定时推送管理
+		wsRouter.POST("msg/schedule/add", handler.AddMsgScheduleHandler)
+		wsRouter.GET("msg/schedule/list", handler.GetMsgScheduleListHandler)
+		wsRouter.POST("msg/schedule/update", handler.UpdateMsgScheduleHandler)
+		wsRouter.POST("msg/schedule/cancel", handler.CancelMsgScheduleHandler)
+
+		// 死信消息管理
+		wsRouter.GET("msg/dead_letter/list", handler.GetDeadLetterListHandler)
+		wsRouter.GET("msg/dead_letter/info", handler.GetDeadLetterHandler)
+		wsRouter.POST("msg/dead_letter/replay", handler.ReplayDeadLetterHandler)
+		wsRouter.POST("msg/dead_letter/purge", handler.PurgeDeadLetterHandler)
+
 	}
 
 	return router
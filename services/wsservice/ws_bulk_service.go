@@ -0,0 +1,245 @@
+package wsservice
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	// 批量推送任务的进度
+	msgBulkJobPreCacheKey = "ws_msg_bulk_job:"
+	// 批量推送任务进度的保存时间(s)
+	msgBulkJobTTL = 86400
+	// 每批写入的消息数
+	msgBulkBatchSize = 500
+)
+
+// 批量推送任务状态
+const (
+	BulkJobRunning = "running"
+	BulkJobDone    = "done"
+)
+
+// 按用户标签和链接信息筛选推送的用户
+type Segment struct {
+	Tags   []string    `json:"tags,omitempty" form:"tags"`     // 同时拥有所有标签的用户
+	Conn   *ConnFilter `json:"conn,omitempty" form:"-"`        // 有满足条件的在线链接的用户，只支持json
+	Online bool        `json:"online,omitempty" form:"online"` // 只推送在线的用户
+}
+
+// 是否没有设置任何筛选条件
+func (s *Segment) IsEmpty() bool {
+	return s == nil || len(s.Tags) == 0 && s.Conn.IsEmpty() && !s.Online
+}
+
+// 每个用户的写入结果
+type BulkResult struct {
+	UID   int    `json:"uid"`
+	ID    string `json:"id,omitempty"`
+	Seq   int64  `json:"seq,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// 批量推送任务进度
+type BulkJob struct {
+	ID         string `json:"id"`
+	State      string `json:"state"`
+	Total      int    `json:"total"`
+	Sent       int    `json:"sent"`
+	Failed     int    `json:"failed"`
+	CreatedAt  int64  `json:"created_at"`
+	FinishedAt int64  `json:"finished_at,omitempty"`
+}
+
+// 查找满足筛选条件的用户，设置标签时在标签用户中筛选，否则在链接过的用户中筛选
+func ResolveSegment(s *Segment) (userIdList []int, err error) {
+	if len(s.Tags) > 0 {
+		userIdList, err = GetTagUserIdList(s.Tags)
+	} else {
+		userIdList, err = GetOnLineUserIdList()
+	}
+	if err != nil || (!s.Online && s.Conn.IsEmpty()) {
+		return
+	}
+
+	result := userIdList[:0]
+	for _, userId := range userIdList {
+		userConnList, err := GetAllUserInfoList(userId)
+		if err != nil {
+			continue
+		}
+		for _, userConn := range userConnList {
+			if !userConn.Closed && s.Conn.Match(userConn) {
+				result = append(result, userId)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// 去除重复的用户ID，保持原有顺序
+func uniqueUserIds(userIdList []int) []int {
+	seen := make(map[int]bool, len(userIdList))
+	result := make([]int, 0, len(userIdList))
+	for _, userId := range userIdList {
+		if !seen[userId] {
+			seen[userId] = true
+			result = append(result, userId)
+		}
+	}
+	return result
+}
+
+// 以msg为模板给每个用户生成消息并批量写入队列，callbackUrl不为空时状态变更后回调通知
+func SendBulkMsg(msg Msg, userIdList []int, callbackUrl string) (results []BulkResult) {
+	userIdList = uniqueUserIds(userIdList)
+	results = make([]BulkResult, 0, len(userIdList))
+	for start := 0; start < len(userIdList); start += msgBulkBatchSize {
+		end := start + msgBulkBatchSize
+		if end > len(userIdList) {
+			end = len(userIdList)
+		}
+
+		msgs := make([]*Msg, 0, end-start)
+		for _, userId := range userIdList[start:end] {
+			m := msg
+			m.ID = NewMsgId()
+			m.UID = userId
+			// 先记录状态，避免消息分发时状态还未创建
+			_ = m.InitMsgStatus(callbackUrl)
+			msgs = append(msgs, &m)
+		}
+
+		errList := PushWsMsgsToQueue(msgs)
+		for i, m := range msgs {
+			result := BulkResult{UID: m.UID, ID: m.ID, Seq: m.Seq}
+			if errList[i] != nil {
+				result.Error = errList[i].Error()
+				result.Seq = 0
+			}
+			results = append(results, result)
+		}
+	}
+	return
+}
+
+// 创建异步批量推送任务，返回任务ID，可通过GetBulkJob查询进度
+func StartBulkJob(msg Msg, userIdList []int, segment *Segment, callbackUrl string) (job BulkJob, err error) {
+	userIdList = uniqueUserIds(userIdList)
+	job = BulkJob{
+		ID:        uuid.New().String(),
+		State:     BulkJobRunning,
+		Total:     len(userIdList),
+		CreatedAt: time.Now().Unix(),
+	}
+	if err = job.save(); err != nil {
+		return
+	}
+
+	go func() {
+		if !segment.IsEmpty() {
+			segmentUserIdList, err := ResolveSegment(segment)
+			if err != nil {
+				logger.Logger.Warn("resolve websocket bulk msg segment failed", zap.String("job_id", job.ID), zap.Error(err))
+			}
+			// 同时在uids和筛选结果中的用户只推送一次
+			userIdList = uniqueUserIds(append(userIdList, segmentUserIdList...))
+			job.Total = len(userIdList)
+			_ = job.save()
+		}
+
+		for start := 0; start < len(userIdList); start += msgBulkBatchSize {
+			end := start + msgBulkBatchSize
+			if end > len(userIdList) {
+				end = len(userIdList)
+			}
+			sent, failed := 0, 0
+			for _, result := range SendBulkMsg(msg, userIdList[start:end], callbackUrl) {
+				if result.Error == "" {
+					sent++
+				} else {
+					failed++
+				}
+			}
+			job.incr(sent, failed)
+		}
+
+		job.State = BulkJobDone
+		job.FinishedAt = time.Now().Unix()
+		rd := myredis.NewRedis("default_redis").Get()
+		rd.Do("hMSet", msgBulkJobPreCacheKey+job.ID, "state", job.State, "finished_at", job.FinishedAt)
+		rd.Close()
+
+		logger.Logger.Info("websocket bulk msg job done", zap.String("job_id", job.ID), zap.Int("total", job.Total))
+	}()
+	return
+}
+
+// 保存任务信息
+func (job *BulkJob) save() (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgBulkJobPreCacheKey + job.ID
+	rd.Send("MULTI")
+	rd.Send("hMSet", cacheKey, "id", job.ID, "state", job.State, "total", job.Total, "created_at", job.CreatedAt)
+	rd.Send("expire", cacheKey, msgBulkJobTTL)
+	_, err = rd.Do("EXEC")
+	if err != nil {
+		logger.Logger.Warn("save websocket bulk msg job failed", zap.Any("job", job), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 更新任务进度
+func (job *BulkJob) incr(sent, failed int) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgBulkJobPreCacheKey + job.ID
+	rd.Send("MULTI")
+	rd.Send("hIncrBy", cacheKey, "sent", sent)
+	rd.Send("hIncrBy", cacheKey, "failed", failed)
+	if _, err := rd.Do("EXEC"); err != nil {
+		logger.Logger.Warn("update websocket bulk msg job failed", zap.String("job_id", job.ID), zap.Error(err))
+	}
+}
+
+// 查询批量推送任务进度
+func GetBulkJob(id string) (job BulkJob, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	var values []interface{}
+	values, err = redis.Values(rd.Do("hGetAll", msgBulkJobPreCacheKey+id))
+	if err != nil {
+		logger.Logger.Warn("get websocket bulk msg job failed", zap.String("job_id", id), zap.Error(err))
+		return
+	}
+	if len(values) == 0 {
+		err = errs.ErrBulkJobNotFound
+		return
+	}
+
+	var fields struct {
+		ID         string `redis:"id"`
+		State      string `redis:"state"`
+		Total      int    `redis:"total"`
+		Sent       int    `redis:"sent"`
+		Failed     int    `redis:"failed"`
+		CreatedAt  int64  `redis:"created_at"`
+		FinishedAt int64  `redis:"finished_at"`
+	}
+	if err = redis.ScanStruct(values, &fields); err != nil {
+		return
+	}
+	job = BulkJob(fields)
+	return
+}
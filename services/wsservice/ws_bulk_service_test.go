@@ -0,0 +1,22 @@
+package wsservice
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUniqueUserIds(t *testing.T) {
+	tests := []struct {
+		userIdList []int
+		want       []int
+	}{
+		{nil, []int{}},
+		{[]int{1, 2, 3}, []int{1, 2, 3}},
+		{[]int{3, 1, 3, 2, 1}, []int{3, 1, 2}},
+	}
+	for _, tt := range tests {
+		if got := uniqueUserIds(tt.userIdList); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("uniqueUserIds(%v) = %v, want %v", tt.userIdList, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package wsservice
+
+import (
+	"strings"
+)
+
+// 按链接的设备信息筛选推送的链接，同一字段内任意一个值匹配即可，多个字段需同时匹配
+type ConnFilter struct {
+	ConnIds     []string `json:"conn_ids,omitempty" form:"conn_ids"`
+	DeviceIds   []string `json:"device_ids,omitempty" form:"device_ids"`
+	Platforms   []string `json:"platforms,omitempty" form:"platforms"`
+	AppVersions []string `json:"app_versions,omitempty" form:"app_versions"`
+	Locales     []string `json:"locales,omitempty" form:"locales"`
+}
+
+func matchAny(values []string, v string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否没有设置任何筛选条件
+func (f *ConnFilter) IsEmpty() bool {
+	return f == nil || len(f.ConnIds) == 0 && len(f.DeviceIds) == 0 && len(f.Platforms) == 0 && len(f.AppVersions) == 0 && len(f.Locales) == 0
+}
+
+// 链接是否满足筛选条件，没有设置条件时都满足
+func (f *ConnFilter) Match(w *WsUserConnInfo) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	if len(f.ConnIds) > 0 && !matchAny(f.ConnIds, w.ID) {
+		return false
+	}
+	if len(f.DeviceIds) > 0 && !matchAny(f.DeviceIds, w.DeviceId) {
+		return false
+	}
+	if len(f.Platforms) > 0 && !matchAny(f.Platforms, w.Platform) {
+		return false
+	}
+	if len(f.AppVersions) > 0 && !matchAny(f.AppVersions, w.AppVersion) {
+		return false
+	}
+	if len(f.Locales) > 0 && !matchAny(f.Locales, w.Locale) {
+		return false
+	}
+	return true
+}
+
+// 消息是否推送给该链接，需满足include且不满足exclude，且不是发起操作的链接
+func (m Msg) MatchConn(w *WsUserConnInfo) bool {
+	if m.OriginConnId != "" && m.OriginConnId == w.ID {
+		return false
+	}
+	if !m.Include.Match(w) {
+		return false
+	}
+	if !m.Exclude.IsEmpty() && m.Exclude.Match(w) {
+		return false
+	}
+	return true
+}
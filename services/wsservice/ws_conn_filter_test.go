@@ -0,0 +1,48 @@
+package wsservice
+
+import "testing"
+
+func TestConnFilterMatch(t *testing.T) {
+	conn := &WsUserConnInfo{ID: "c1", DeviceId: "d1", Platform: "ios", AppVersion: "1.2.0", Locale: "zh-CN"}
+	tests := []struct {
+		name   string
+		filter *ConnFilter
+		want   bool
+	}{
+		{"nil", nil, true},
+		{"empty", &ConnFilter{}, true},
+		{"conn id", &ConnFilter{ConnIds: []string{"c2", "c1"}}, true},
+		{"conn id mismatch", &ConnFilter{ConnIds: []string{"c2"}}, false},
+		{"platform ignore case", &ConnFilter{Platforms: []string{"IOS"}}, true},
+		{"all fields", &ConnFilter{DeviceIds: []string{"d1"}, Platforms: []string{"ios"}, AppVersions: []string{"1.2.0"}, Locales: []string{"zh-cn"}}, true},
+		{"one field mismatch", &ConnFilter{Platforms: []string{"ios"}, Locales: []string{"en-US"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(conn); got != tt.want {
+			t.Errorf("%s: Match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMsgMatchConn(t *testing.T) {
+	conn := &WsUserConnInfo{ID: "c1", Platform: "web"}
+	tests := []struct {
+		name string
+		msg  Msg
+		want bool
+	}{
+		{"no filter", Msg{}, true},
+		{"origin conn", Msg{OriginConnId: "c1"}, false},
+		{"other origin conn", Msg{OriginConnId: "c2"}, true},
+		{"include", Msg{Include: &ConnFilter{Platforms: []string{"web"}}}, true},
+		{"include mismatch", Msg{Include: &ConnFilter{Platforms: []string{"ios"}}}, false},
+		{"exclude", Msg{Exclude: &ConnFilter{Platforms: []string{"web"}}}, false},
+		{"exclude mismatch", Msg{Exclude: &ConnFilter{Platforms: []string{"ios"}}}, true},
+		{"empty exclude", Msg{Exclude: &ConnFilter{}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.msg.MatchConn(conn); got != tt.want {
+			t.Errorf("%s: MatchConn = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
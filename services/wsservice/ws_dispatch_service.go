@@ -0,0 +1,386 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+const (
+	// 有待推送消息的用户ID通知队列，各实例阻塞读取
+	msgReadyListKey = "ws_user_msg_ready_list"
+	// 延迟队列索引，成员为用户ID，分值为该用户最早到期的消息时间
+	msgDelayIndexKey = "ws_user_msg_delay_index"
+	// 阻塞读取通知队列的超时时间(s)
+	msgReadyBlockTimeout = 5
+	// 每次从延迟队列取出的最大消息数
+	msgDelayBatchSize = 100
+	// 用户消息分发锁的过期时间(s)
+	msgDispatchLockTTL = 30
+	// 等待其他实例分发完成的最长时间
+	msgDispatchLockWait = 10 * time.Second
+)
+
+var (
+	// 按用户ID分片的推送协程，保证同一用户的消息在本实例按顺序推送
+	dispatchWorkers []chan int
+	// 本实例写入延迟队列后唤醒延迟检查
+	delayWakeup = make(chan struct{}, 1)
+)
+
+// 启动本实例的消息分发，所有链接共用，redis请求数与实例数相关而与链接数无关
+func StartDispatcher() {
+	count := config.Settings.Websocket.DispatchWorkers
+	dispatchWorkers = make([]chan int, count)
+	for i := range dispatchWorkers {
+		dispatchWorkers[i] = make(chan int, 1024)
+		go dispatchWorker(dispatchWorkers[i])
+	}
+
+	go dispatchReadyLoop()
+	go dispatchDelayLoop()
+}
+
+// 通知有用户的消息待推送
+func NotifyUserMsgReady(userId int) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	_, err = rd.Do("rPush", msgReadyListKey, userId)
+	if err != nil {
+		logger.Logger.Warn("notify websocket user msg ready failed", zap.Int("user_id", userId), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 阻塞读取待推送的用户ID，交给对应的分片协程
+func dispatchReadyLoop() {
+	for !IsDraining() {
+		rd := myredis.NewRedis("default_redis").Get()
+		// 阻塞时间超过连接池的读超时，需要单独指定超时时间
+		reply, err := redis.Strings(redis.DoWithTimeout(rd, (msgReadyBlockTimeout+1)*time.Second, "blPop", msgReadyListKey, msgReadyBlockTimeout))
+		rd.Close()
+		if err != nil {
+			if err != redis.ErrNil {
+				logger.Logger.Warn("blPop websocket user msg ready list failed", zap.Error(err))
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		userId, err := strconv.Atoi(reply[1])
+		if err != nil {
+			continue
+		}
+		// 取模结果保持符号，转为无符号数避免下标为负
+		dispatchWorkers[uint(userId)%uint(len(dispatchWorkers))] <- userId
+	}
+}
+
+// 推送用户队列中的所有消息，用户没有在线链接时保存为离线消息，等待用户上线
+func dispatchWorker(userIds chan int) {
+	for userId := range userIds {
+		// 同一用户同一时间只由一个实例分发，其他实例等待，保证按序号推送
+		lockKey := msgDispatchLockPreCacheKey + strconv.Itoa(userId)
+		token, ok := waitLock(lockKey, msgDispatchLockTTL, msgDispatchLockWait)
+		if !ok {
+			// 等待超时，重新通知稍后再分发
+			_ = NotifyUserMsgReady(userId)
+			continue
+		}
+
+		// 获取锁后再读取链接，等待期间新建立的链接也能收到消息
+		userConnList, err := GetAllUserInfoList(userId)
+		if err != nil {
+			logger.Logger.Warn("get user all websocket conn id failed", zap.Int("user_id", userId), zap.Error(err))
+			releaseLock(lockKey, token)
+			_ = NotifyUserMsgReady(userId)
+			continue
+		}
+		dispatchUserMsg(userId, userConnList)
+		releaseLock(lockKey, token)
+	}
+}
+
+// 按顺序推送用户队列中的所有消息
+func dispatchUserMsg(userId int, userConnList []*WsUserConnInfo) {
+	if useStreamInbox() {
+		dispatchStreamMsg(userId, userConnList)
+		return
+	}
+	picker := newPriorityPicker()
+	for {
+		msg, err := PopWsMsgFromQueue(userId, picker.order())
+		if err != nil {
+			return
+		}
+		picker.served(msg.lane())
+		if msg.dropStale() {
+			continue
+		}
+		count, failed := msg.dispatch(userConnList)
+		if count == 0 && failed > 0 {
+			// 写入失败的消息重新入队，由下次分发推送
+			requeueMsg(msg)
+			return
+		}
+		if count == 0 && !hasOpenConn(userConnList) {
+			_ = msg.SaveOfflineMsg()
+		}
+	}
+}
+
+// 推送用户stream中的新消息，不需要ACK的消息推送后即确认，需要ACK的消息在所有链接都收到ACK或重试结束后确认
+func dispatchStreamMsg(userId int, userConnList []*WsUserConnInfo) {
+	picker := newPriorityPicker()
+	for {
+		msgs, err := ReadWsMsgFromStream(userId)
+		if err != nil || len(msgs) == 0 {
+			return
+		}
+		requeued := false
+		for _, msg := range picker.sort(msgs) {
+			if msg.dropStale() {
+				_ = msg.AckWsMsgStream()
+				continue
+			}
+			count, failed := msg.dispatch(userConnList)
+			switch {
+			case count > 0 && msg.Retries <= 0:
+				_ = msg.AckWsMsgStream()
+			case count > 1:
+				// 每个链接的重试结束后各确认一次，最后一个链接结束后才确认stream中的消息
+				_ = msg.SetWsMsgStreamRefs(count)
+			case count == 1:
+				// 只推送给一个链接，由该链接的重试结果确认
+			case failed > 0:
+				// 写入失败的消息重新入队并确认原消息，本批处理完后结束，由下次分发推送
+				requeueMsg(msg)
+				requeued = true
+			case !hasOpenConn(userConnList):
+				if msg.SaveOfflineMsg() == nil {
+					_ = msg.AckWsMsgStream()
+				}
+			default:
+				// 没有满足筛选条件的链接
+				_ = msg.AckWsMsgStream()
+			}
+		}
+		if requeued {
+			return
+		}
+	}
+}
+
+// 用户是否有未关闭的链接，有链接但都不满足筛选条件的消息不保存为离线消息
+func hasOpenConn(userConnList []*WsUserConnInfo) bool {
+	for _, userConn := range userConnList {
+		if !userConn.Closed {
+			return true
+		}
+	}
+	return false
+}
+
+// 向某个用户的所有链接同步推送消息，推送到其他服务器时等待返回，保证同一链接按顺序收到消息，返回推送成功和失败的链接数
+func (m Msg) dispatch(userConnList []*WsUserConnInfo) (count, failed int) {
+	for _, userConn := range userConnList {
+		// 跳过已关闭和不满足设备筛选条件的链接
+		if userConn.Closed || !m.MatchConn(userConn) {
+			continue
+		}
+		// 由链接所在的服务器推送并记录延迟队列
+		var err error
+		if _, ok := GetLocalUserConn(userConn.ID); ok {
+			err = m.PushMsg(userConn.ID)
+		} else {
+			err = m.PushMsgToOtherServer(userConn.Node, userConn.ID)
+		}
+		if err == nil {
+			count++
+			// 记录分发的链接，撤回和编辑时通知还未写入的链接
+			go m.UpdateMsgStatus(MsgStatusDispatched, userConn.ID, "")
+		} else {
+			failed++
+		}
+	}
+
+	if count > 0 {
+		go m.releaseCollapseKey()
+	}
+
+	logger.Logger.Info("send websocket msg success", zap.Int("user_id", m.UID), zap.Any("msg", m), zap.Int("count", count))
+	return
+}
+
+// 取出到期的延迟消息检查ACK，没有到期消息时等到最早的到期时间
+func dispatchDelayLoop() {
+	for !IsDraining() {
+		messages, next, err := popDueWsMsgs(msgDelayBatchSize)
+		if err != nil {
+			logger.Logger.Warn("pop websocket msg from delay queue failed", zap.Error(err))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, msg := range messages {
+			msg.checkAck()
+		}
+		if len(messages) == msgDelayBatchSize {
+			continue
+		}
+
+		// 最长等待1秒，兼顾其他实例写入的更早到期的消息
+		wait := time.Second
+		if next > 0 {
+			if d := time.Until(time.Unix(next, 0)); d < wait {
+				wait = d
+			}
+		}
+		if wait <= 0 {
+			continue
+		}
+		select {
+		case <-delayWakeup:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// 通知延迟检查有新消息
+func wakeupDelayLoop() {
+	select {
+	case delayWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// 取出某个用户延迟队列中到期的消息并更新索引，保证多个实例不会取到同一条消息
+var popDueUserWsMsgsScript = redis.NewScript(2, `
+	local messages = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+	for _, message in ipairs(messages) do
+		redis.call('ZREM', KEYS[2], message)
+	end
+	local first = redis.call('ZRANGE', KEYS[2], 0, 0, 'WITHSCORES')
+	if #first > 0 then
+		redis.call('ZADD', KEYS[1], first[2], ARGV[3])
+	else
+		redis.call('ZREM', KEYS[1], ARGV[3])
+	end
+	return messages
+	`)
+
+// 从所有用户的延迟队列中取出到期的消息，同时返回下一个消息的到期时间
+func popDueWsMsgs(limit int) (msgs []Msg, next int64, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	now := time.Now().Unix()
+	var userIds []string
+	userIds, err = redis.Strings(rd.Do("zRangeByScore", msgDelayIndexKey, "-inf", now, "LIMIT", 0, limit))
+	if err != nil {
+		return
+	}
+
+	// 已取出的消息必须返回处理，某个用户出错时只记录日志
+	var messages []string
+	for _, uid := range userIds {
+		reply, err := redis.Strings(popDueUserWsMsgsScript.Do(rd, msgDelayIndexKey, msgDelayQueuePreCacheKey+uid, now, limit-len(messages), uid))
+		if err != nil {
+			logger.Logger.Warn("pop websocket user msg from delay queue failed", zap.String("user_id", uid), zap.Error(err))
+			break
+		}
+		messages = append(messages, reply...)
+		if len(messages) >= limit {
+			break
+		}
+	}
+	for _, data := range messages {
+		var msg Msg
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			logger.Logger.Warn("websocket delay queue msg json unmarshal failed", zap.String("data", data), zap.Error(err))
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	first, _ := redis.Strings(rd.Do("zRange", msgDelayIndexKey, 0, 0, "WITHSCORES"))
+	if len(first) == 2 {
+		next, _ = strconv.ParseInt(first[1], 10, 64)
+	}
+	return
+}
+
+// 检查推送的消息是否收到ACK，没有收到就按重试策略重新推送，不再重推时确认stream中的消息
+func (m Msg) checkAck() {
+	retry, reason := m.retryUnacked()
+	if reason != "" {
+		_ = m.SaveDeadLetter(reason)
+	}
+	if !retry {
+		_ = m.AckWsMsgStream()
+	}
+}
+
+// 没有收到ACK时重新推送，返回消息是否还会继续重推，不再重推且未收到ACK时返回进入死信队列的原因
+func (m Msg) retryUnacked() (retry bool, reason string) {
+	// 判断之前发送的链接有收到ACK，删除ACK记录，如没有收到消息的ACK记录会返回nil报错
+	_, err := GetMsgAck(m.UID, m.ID, m.ConnId)
+	if err == nil {
+		go DelMsgAck(m.UID, m.ID, m.ConnId)
+		return false, ""
+	}
+	// 已过期或被新消息替换的消息不再重推
+	if m.dropStale() {
+		return false, ""
+	}
+
+	// 没有收到ACK，就再发一次，PushMsg会重新记录延迟队列
+	if userConn, ok := GetLocalUserConn(m.ConnId); ok {
+		if m.isAckedBySeq(userConn) {
+			return false, ""
+		}
+		if m.Retries <= 0 {
+			return false, DeadLetterRetriesExhausted
+		}
+		m.Retries, m.Attempt = m.Retries-1, m.Attempt+1
+		if m.PushMsg(userConn.ID) != nil {
+			// 链接正在关闭，下次检查时按链接状态处理
+			go m.PushWsMsgToDelayQueue()
+		}
+		return true, ""
+	}
+
+	// 查找客户端
+	userConn, err := GetWsUserConnInfo(m.ConnId)
+	if err == redis.ErrNil {
+		return false, DeadLetterConnectionNotFound
+	}
+	if err != nil {
+		go m.PushWsMsgToDelayQueue()
+		return true, ""
+	}
+	if m.isAckedBySeq(userConn) {
+		return false, ""
+	}
+	if m.Retries <= 0 {
+		return false, DeadLetterRetriesExhausted
+	}
+	if userConn.Closed {
+		// 断线重连宽限时间内保留消息，等待客户端重连接管
+		if userConn.DisConnectTime+int64(config.Settings.Websocket.ResumeGrace) > time.Now().Unix() {
+			go m.PushWsMsgToDelayQueue()
+			return true, ""
+		}
+		return false, DeadLetterConnectionClosed
+	}
+	m.Retries, m.Attempt = m.Retries-1, m.Attempt+1
+	go m.PushMsgToOtherServer(userConn.Node, userConn.ID)
+	return true, ""
+}
@@ -0,0 +1,172 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// 服务是否正在下线
+	draining int32
+	// 下线推送缓冲区消息的截止时间
+	drainDeadline atomic.Value
+)
+
+// 服务是否正在下线，下线时不再接受新链接
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// 服务下线：通知客户端到其他服务器重连，推送完缓冲区的消息，
+// 未确认和未推送的消息重新入队，并更新redis中的链接状态
+func Drain() {
+	if !atomic.CompareAndSwapInt32(&draining, 0, 1) {
+		return
+	}
+	timeout := time.Duration(config.Settings.Websocket.DrainTimeout) * time.Second
+	drainDeadline.Store(time.Now().Add(timeout))
+
+	allWsUserConnInfosMu.RLock()
+	var userConnList = make([]*WsUserConnInfo, 0, len(AllWsUserConnInfos))
+	for _, w := range AllWsUserConnInfos {
+		userConnList = append(userConnList, w)
+	}
+	allWsUserConnInfosMu.RUnlock()
+
+	logger.Logger.Info("websocket node draining", zap.String("node", LocalNode()), zap.Int("count", len(userConnList)), zap.Duration("timeout", timeout))
+
+	// 重连时间加随机抖动，避免客户端同时重连
+	jitter := config.Settings.Websocket.DrainRetryJitter
+	for _, w := range userConnList {
+		retryAfter := 0
+		if jitter > 0 {
+			retryAfter = rand.Intn(jitter)
+		}
+		w.Close(errs.CloseReconnectElsewhere.WithReason("retry_after_ms=" + strconv.Itoa(retryAfter)))
+	}
+
+	// 等待写协程推送完缓冲区的消息
+	done := make(chan struct{})
+	go func() {
+		writePumpWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Logger.Warn("websocket node drain timeout", zap.String("node", LocalNode()))
+	}
+
+	for _, w := range userConnList {
+		w.requeueUnsent()
+		requeueUnackedMsg(w)
+		w.markClosed()
+	}
+
+	unregisterNodeInstance()
+	logger.Logger.Info("websocket node drained", zap.String("node", LocalNode()))
+}
+
+// 在下线截止时间前推送缓冲区的消息
+func (w *WsUserConnInfo) flush() {
+	deadline, _ := drainDeadline.Load().(time.Time)
+	for time.Now().Before(deadline) {
+		frame, ok := w.nextFrame()
+		if !ok {
+			return
+		}
+		if err := w.wsConnection.Send(frame.data); err != nil {
+			// 推送失败的消息重新入队
+			if frame.msg != nil {
+				requeueMsg(*frame.msg)
+			}
+			return
+		}
+		w.delivered(frame)
+	}
+}
+
+// 缓冲区中未推送的消息重新入队，需要ACK的消息已在延迟队列，由requeueUnackedMsg处理
+func (w *WsUserConnInfo) requeueUnsent() {
+	for {
+		frame, ok := w.nextFrame()
+		if !ok {
+			return
+		}
+		if frame.msg != nil && frame.msg.Retries <= 0 {
+			requeueMsg(*frame.msg)
+		}
+	}
+}
+
+// 消息重新写入用户的消息队列，由用户的其他链接或重连后的链接推送
+func requeueMsg(msg Msg) {
+	old := msg
+	msg.ConnId = ""
+	msg.ConnSeq = 0
+	msg.StreamId = ""
+	if msg.PushWsMsgToQueue() == nil {
+		// 使用stream存储时确认原消息，由重新写入的消息推送
+		_ = old.AckWsMsgStream()
+	}
+}
+
+// 延迟队列中发给某个链接的未确认消息重新入队，已确认的消息和延迟检查一样直接删除
+func requeueUnackedMsg(w *WsUserConnInfo) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	userId, userConnId := w.UID, w.ID
+	cacheKey := msgDelayQueuePreCacheKey + strconv.Itoa(userId)
+	var messages []string
+	messages, err = redis.Strings(rd.Do("zRange", cacheKey, 0, -1))
+	if err != nil {
+		logger.Logger.Warn("get websocket delay queue msg failed", zap.Int("user_id", userId), zap.Error(err))
+		return
+	}
+
+	for _, message := range messages {
+		var msg Msg
+		if json.Unmarshal([]byte(message), &msg) != nil || msg.ConnId != userConnId {
+			continue
+		}
+		// 只有删除成功的才重新入队，避免和延迟检查重复推送
+		removed, err := redis.Int(rd.Do("zRem", cacheKey, message))
+		if err != nil || removed == 0 {
+			continue
+		}
+		if _, err := GetMsgAck(userId, msg.ID, userConnId); err == nil {
+			DelMsgAck(userId, msg.ID, userConnId)
+			_ = msg.AckWsMsgStream()
+			continue
+		}
+		if msg.isAckedBySeq(w) {
+			_ = msg.AckWsMsgStream()
+			continue
+		}
+		requeueMsg(msg)
+	}
+	return
+}
+
+// 正常下线时删除本实例的注册信息
+func unregisterNodeInstance() {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	rd.Send("MULTI")
+	rd.Send("hDel", wsNodeInstanceListKey, localInstance)
+	rd.Send("del", wsNodeInstanceAlivePreCacheKey+localInstance, wsNodeInstanceConnListPreCacheKey+localInstance)
+	if _, err := rd.Do("EXEC"); err != nil {
+		logger.Logger.Warn("unregister websocket node instance failed", zap.String("instance", localInstance), zap.Error(err))
+	}
+}
@@ -0,0 +1,83 @@
+package wsservice
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+const (
+	// 发送请求的幂等key，值为首次发送的结果
+	msgIdempotencyPreCacheKey = "ws_msg_idempotency:"
+	// 首次发送还未完成时的占位值
+	msgIdempotencyPending = "-"
+	// 等待首次发送完成的最长时间
+	msgIdempotencyWait = 3 * time.Second
+)
+
+// 占用幂等key，key已存在时返回首次发送的结果
+func ReserveIdempotencyKey(userId int, key string) (result []byte, reserved bool, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgIdempotencyPreCacheKey + strconv.Itoa(userId) + ":" + key
+	// 重复请求，等待首次发送完成后返回相同的结果，首次发送失败已释放时重新占用
+	deadline := time.Now().Add(msgIdempotencyWait)
+	for {
+		_, err = redis.String(rd.Do("set", cacheKey, msgIdempotencyPending, "EX", config.Settings.Websocket.IdempotencyWindow, "NX"))
+		if err == nil {
+			return nil, true, nil
+		}
+		if err != redis.ErrNil {
+			logger.Logger.Warn("reserve websocket msg idempotency key failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+			return
+		}
+
+		result, err = redis.Bytes(rd.Do("get", cacheKey))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			logger.Logger.Warn("get websocket msg idempotency result failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+			return
+		}
+		if string(result) != msgIdempotencyPending {
+			logger.Logger.Info("duplicate websocket msg send request", zap.String("cacheKey", cacheKey))
+			return result, false, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, false, errs.ErrMsgSendInProgress
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// 保存首次发送的结果，在幂等窗口内返回给重复请求
+func SaveIdempotencyResult(userId int, key string, result []byte) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgIdempotencyPreCacheKey + strconv.Itoa(userId) + ":" + key
+	_, err = rd.Do("set", cacheKey, result, "EX", config.Settings.Websocket.IdempotencyWindow)
+	if err != nil {
+		logger.Logger.Warn("save websocket msg idempotency result failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 发送失败时释放幂等key，允许重试
+func ReleaseIdempotencyKey(userId int, key string) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgIdempotencyPreCacheKey + strconv.Itoa(userId) + ":" + key
+	if _, err := rd.Do("del", cacheKey); err != nil {
+		logger.Logger.Warn("release websocket msg idempotency key failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+	}
+}
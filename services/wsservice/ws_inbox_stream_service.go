@@ -0,0 +1,302 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+)
+
+// 用户消息队列的存储方式
+const (
+	// redis list，读取后即删除
+	InboxBackendList = "list"
+	// redis stream，客户端ACK后才确认，实例宕机后由其他实例接管未确认的消息
+	InboxBackendStream = "stream"
+)
+
+const (
+	// 用户消息stream前缀
+	msgStreamPreCacheKey = "ws_user_msg_stream:"
+	// 消息分发的消费组，每个实例是组内的一个消费者
+	msgStreamGroup = "ws_msg_dispatch"
+	// 实例读取过的用户ID列表，实例宕机后据此接管未确认的消息
+	wsNodeInstanceStreamListPreCacheKey = "ws_node_instance_stream_list:"
+	// 推送给多个链接的stream消息还未结束重试的链接数，为0时确认消息
+	msgStreamRefsPreCacheKey = "ws_user_msg_stream_refs:"
+	// stream中还未读取的消息编辑后的内容，按消息ID保存，读取时替换
+	msgStreamEditPreCacheKey = "ws_user_msg_stream_edit:"
+	// 每次读取和接管的最大消息数
+	msgStreamBatchSize = 100
+)
+
+// 是否使用stream存储用户消息
+func useStreamInbox() bool {
+	return config.Settings.Websocket.InboxBackend == InboxBackendStream
+}
+
+// 以本实例的身份读取用户各优先级stream中的新消息，消费组不存在时创建
+func ReadWsMsgFromStream(userId int) (msgs []Msg, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	args := redis.Args{}.Add("GROUP", msgStreamGroup, localInstance, "COUNT", msgStreamBatchSize, "STREAMS")
+	var cacheKeys []string
+	for lane := 0; lane < msgPriorityLanes; lane++ {
+		cacheKeys = append(cacheKeys, laneQueueKey(msgStreamPreCacheKey, userId, lane))
+	}
+	args = args.AddFlat(cacheKeys)
+	for range cacheKeys {
+		args = args.Add(">")
+	}
+
+	var reply interface{}
+	for i := 0; i < 2; i++ {
+		reply, err = rd.Do("xReadGroup", args...)
+		if err == nil || !strings.HasPrefix(err.Error(), "NOGROUP") {
+			break
+		}
+		for _, cacheKey := range cacheKeys {
+			_, err = rd.Do("xGroup", "CREATE", cacheKey, msgStreamGroup, "0", "MKSTREAM")
+			if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+				break
+			}
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		logger.Logger.Warn("xReadGroup websocket user msg from stream failed", zap.Strings("cacheKeys", cacheKeys), zap.Error(err))
+		return
+	}
+	if reply == nil {
+		return
+	}
+
+	// 记录本实例读取过的用户，宕机后由其他实例接管
+	_, _ = rd.Do("sAdd", wsNodeInstanceStreamListPreCacheKey+localInstance, userId)
+
+	// 返回格式为 [[key, [[id, [field, value]], ...]], ...]
+	var streams []interface{}
+	streams, err = redis.Values(reply, nil)
+	if err != nil {
+		return
+	}
+	for _, s := range streams {
+		stream, err := redis.Values(s, nil)
+		if err != nil || len(stream) < 2 {
+			continue
+		}
+		laneMsgs, _ := parseStreamEntries(stream[1])
+		msgs = append(msgs, laneMsgs...)
+	}
+	applyStreamMsgEdits(rd, userId, msgs)
+	return
+}
+
+// 替换stream消息编辑后的内容
+func applyStreamMsgEdits(rd redis.Conn, userId int, msgs []Msg) {
+	if len(msgs) == 0 {
+		return
+	}
+	cacheKey := msgStreamEditPreCacheKey + strconv.Itoa(userId)
+	args := redis.Args{}.Add(cacheKey)
+	for _, msg := range msgs {
+		args = args.Add(msg.ID)
+	}
+	edits, err := redis.Strings(rd.Do("hMGet", args...))
+	if err != nil {
+		logger.Logger.Warn("get websocket stream msg edits failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+		return
+	}
+	for i, edit := range edits {
+		if edit == "" {
+			continue
+		}
+		var content interface{}
+		if json.Unmarshal([]byte(edit), &content) == nil {
+			msgs[i].Content = content
+		}
+	}
+}
+
+// 解析stream消息列表
+func parseStreamEntries(reply interface{}) (msgs []Msg, err error) {
+	var entries []interface{}
+	entries, err = redis.Values(reply, nil)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		var values []interface{}
+		values, err = redis.Values(entry, nil)
+		if err != nil || len(values) < 2 {
+			continue
+		}
+		id, _ := redis.String(values[0], nil)
+		fields, _ := redis.StringMap(values[1], nil)
+
+		var msg Msg
+		if err := json.Unmarshal([]byte(fields["msg"]), &msg); err != nil {
+			logger.Logger.Warn("websocket stream msg json unmarshal failed", zap.String("stream_id", id), zap.Any("fields", fields), zap.Error(err))
+			continue
+		}
+		msg.StreamId = id
+		msgs = append(msgs, msg)
+	}
+	err = nil
+	return
+}
+
+// 确认并删除stream中已处理的消息及其编辑后的内容，stream长度即为待推送和推送中的消息数，同时更新用户的队列长度
+// 推送给多个链接的消息每次减少一个链接，还有链接未结束时不确认，返回-1
+var ackWsMsgStreamScript = redis.NewScript(4+msgPriorityLanes, `
+	if redis.call('HINCRBY', KEYS[3], ARGV[2], -1) > 0 then
+		return -1
+	end
+	redis.call('HDEL', KEYS[3], ARGV[2])
+	redis.call('HDEL', KEYS[4], ARGV[4])
+	redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+	redis.call('XDEL', KEYS[1], ARGV[2])
+	local total = 0
+	for i = 5, #KEYS do
+		total = total + redis.call('XLEN', KEYS[i])
+	end
+	if total > 0 then
+		redis.call('ZADD', KEYS[2], total, ARGV[3])
+	else
+		redis.call('ZREM', KEYS[2], ARGV[3])
+	end
+	return total
+	`)
+
+// 记录stream消息推送的链接数，每个链接结束重试后调用一次AckWsMsgStream
+func (m Msg) SetWsMsgStreamRefs(count int) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgStreamRefsPreCacheKey + strconv.Itoa(m.UID)
+	_, err = rd.Do("hSet", cacheKey, m.StreamId, count)
+	if err != nil {
+		logger.Logger.Warn("set websocket stream msg refs failed", zap.String("cacheKey", cacheKey), zap.String("stream_id", m.StreamId), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 确认stream中的消息已处理，推送给多个链接时最后一个链接结束后才确认
+func (m Msg) AckWsMsgStream() (err error) {
+	if m.StreamId == "" {
+		return
+	}
+
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := m.queueKey()
+	uid := strconv.Itoa(m.UID)
+	args := redis.Args{}.Add(cacheKey, msgQueueDepthKey, msgStreamRefsPreCacheKey+uid, msgStreamEditPreCacheKey+uid).Add(userQueueKeys(m.UID)...).Add(msgStreamGroup, m.StreamId, m.UID, m.ID)
+	_, err = ackWsMsgStreamScript.Do(rd, args...)
+	if err != nil {
+		logger.Logger.Warn("xAck websocket user msg failed", zap.String("cacheKey", cacheKey), zap.String("stream_id", m.StreamId), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 接管宕机实例未确认的消息，重新写入用户的stream按正常流程推送
+func claimNodeInstanceStreamMsg(instance string) (count int, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	listKey := wsNodeInstanceStreamListPreCacheKey + instance
+	var userIds []int
+	userIds, err = redis.Ints(rd.Do("sMembers", listKey))
+	if err != nil {
+		logger.Logger.Warn("get node instance stream list failed", zap.String("instance", instance), zap.Error(err))
+		return
+	}
+
+	for _, userId := range userIds {
+		for lane := 0; lane < msgPriorityLanes; lane++ {
+			count += claimStreamMsg(rd, userId, laneQueueKey(msgStreamPreCacheKey, userId, lane), instance)
+		}
+	}
+
+	_, err = rd.Do("del", listKey)
+	return
+}
+
+// 删除延迟队列中接管的stream消息的副本和链接数，由重新写入的消息推送，避免重复推送
+var delWsMsgStreamCopiesScript = redis.NewScript(2, `
+	local ids = {}
+	for i = 1, #ARGV do
+		ids[ARGV[i]] = true
+		redis.call('HDEL', KEYS[2], ARGV[i])
+	end
+	local count = 0
+	for _, message in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+		local ok, msg = pcall(cjson.decode, message)
+		if ok and type(msg['stream_id']) == 'string' and ids[msg['stream_id']] then
+			redis.call('ZREM', KEYS[1], message)
+			count = count + 1
+		end
+	end
+	return count
+	`)
+
+// 接管宕机实例在某个stream中未确认的消息，返回接管的消息数
+func claimStreamMsg(rd redis.Conn, userId int, cacheKey, instance string) (count int) {
+	for {
+		// 返回格式为 [[id, consumer, idle, count], ...]
+		pending, err := redis.Values(rd.Do("xPending", cacheKey, msgStreamGroup, "-", "+", msgStreamBatchSize, instance))
+		if err != nil || len(pending) == 0 {
+			break
+		}
+
+		args := redis.Args{}.Add(cacheKey, msgStreamGroup, localInstance, 0)
+		for _, p := range pending {
+			values, _ := redis.Values(p, nil)
+			if len(values) > 0 {
+				args = args.Add(values[0])
+			}
+		}
+		reply, err := rd.Do("xClaim", args...)
+		if err != nil {
+			logger.Logger.Warn("xClaim websocket user msg failed", zap.String("cacheKey", cacheKey), zap.String("instance", instance), zap.Error(err))
+			break
+		}
+
+		msgs, _ := parseStreamEntries(reply)
+		applyStreamMsgEdits(rd, userId, msgs)
+		if len(msgs) > 0 {
+			uid := strconv.Itoa(userId)
+			copyArgs := redis.Args{}.Add(msgDelayQueuePreCacheKey+uid, msgStreamRefsPreCacheKey+uid)
+			for _, msg := range msgs {
+				copyArgs = copyArgs.Add(msg.StreamId)
+			}
+			if _, err = delWsMsgStreamCopiesScript.Do(rd, copyArgs...); err != nil {
+				logger.Logger.Warn("del websocket stream msg delay copies failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+				break
+			}
+		}
+		for _, msg := range msgs {
+			requeueMsg(msg)
+			count++
+		}
+		// 已被裁剪的消息无法接管，直接确认并删除
+		_, _ = rd.Do("xAck", redis.Args{}.Add(cacheKey, msgStreamGroup).Add(args[4:]...)...)
+		_, _ = rd.Do("xDel", redis.Args{}.Add(cacheKey).Add(args[4:]...)...)
+		if len(pending) < msgStreamBatchSize {
+			break
+		}
+	}
+	return
+}
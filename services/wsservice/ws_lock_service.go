@@ -0,0 +1,77 @@
+package wsservice
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"time"
+)
+
+// 获取分布式锁，成功时返回的token用于释放锁
+func acquireLock(cacheKey string, ttl int) (token string, ok bool) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	token = uuid.New().String()
+	_, err := redis.String(rd.Do("set", cacheKey, token, "EX", ttl, "NX"))
+	if err != nil {
+		if err != redis.ErrNil {
+			logger.Logger.Warn("acquire redis lock failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+		}
+		return "", false
+	}
+	return token, true
+}
+
+// 在超时时间内等待获取分布式锁
+func waitLock(cacheKey string, ttl int, timeout time.Duration) (token string, ok bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if token, ok = acquireLock(cacheKey, ttl); ok || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// 释放分布式锁，只释放自己持有的锁
+func releaseLock(cacheKey, token string) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	luaScript := `
+	if redis.call('GET', KEYS[1]) == ARGV[1] then
+		return redis.call('DEL', KEYS[1])
+	end
+	return 0
+	`
+	script := redis.NewScript(1, luaScript)
+	_, err = script.Do(rd, cacheKey, token)
+	if err != nil {
+		logger.Logger.Warn("release redis lock failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 续期分布式锁，只续期自己持有的锁，锁已丢失时返回false
+func renewLock(cacheKey, token string, ttl int) bool {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	luaScript := `
+	if redis.call('GET', KEYS[1]) == ARGV[1] then
+		return redis.call('EXPIRE', KEYS[1], ARGV[2])
+	end
+	return 0
+	`
+	script := redis.NewScript(1, luaScript)
+	ok, err := redis.Bool(script.Do(rd, cacheKey, token, ttl))
+	if err != nil {
+		logger.Logger.Warn("renew redis lock failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+		return false
+	}
+	return ok
+}
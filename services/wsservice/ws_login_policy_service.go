@@ -0,0 +1,160 @@
+package wsservice
+
+import (
+	"go-ws/config"
+	"go-ws/utils/errs"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 用户登录策略
+const (
+	// 不限制链接数
+	LoginPolicyUnlimited = "unlimited"
+	// 最多max_sessions个链接
+	LoginPolicyMaxSessions = "max_sessions"
+	// 每个平台只保留一个链接
+	LoginPolicyPerPlatform = "per_platform"
+	// 只保留一个链接
+	LoginPolicyExclusive = "exclusive"
+)
+
+// 超出登录限制时的处理方式
+const (
+	// 踢出最早的链接
+	LoginEvictOldest = "oldest"
+	// 拒绝新链接
+	LoginEvictReject = "reject"
+)
+
+const (
+	// 用户登录策略检查锁，保证多个服务器同时登录时结果一致
+	wsUserLoginLockPreCacheKey = "ws_user_login_lock:"
+)
+
+// 同一个分组内最多保留的链接数，分组由登录策略决定
+func loginPolicyLimit() int {
+	switch config.Settings.Websocket.LoginPolicy {
+	case LoginPolicyMaxSessions:
+		return config.Settings.Websocket.MaxSessions
+	case LoginPolicyPerPlatform, LoginPolicyExclusive:
+		return 1
+	}
+	return 0
+}
+
+// 按登录策略关闭链接的原因，客户端据此提示用户
+func loginPolicyCloseReason() errs.CloseReason {
+	if config.Settings.Websocket.LoginEvict == LoginEvictReject {
+		// 并发登录超出限制，关闭的是新链接
+		return errs.CloseLoginRejected
+	}
+	switch config.Settings.Websocket.LoginPolicy {
+	case LoginPolicyMaxSessions:
+		return errs.CloseMaxSessions
+	case LoginPolicyPerPlatform:
+		return errs.ClosePlatformReplaced
+	}
+	return errs.CloseReplacedByNewLogin
+}
+
+// 链接所在的分组，per_platform按平台分组，其他策略所有链接为一组
+func loginPolicyGroup(w *WsUserConnInfo) string {
+	if config.Settings.Websocket.LoginPolicy == LoginPolicyPerPlatform {
+		return w.Platform
+	}
+	return ""
+}
+
+// 获取用户在线的链接，按建立时间从新到旧排序
+func getOnlineUserConnList(userId int) (list []*WsUserConnInfo, err error) {
+	var userConnList []*WsUserConnInfo
+	userConnList, err = GetAllUserInfoList(userId)
+	if err != nil {
+		return
+	}
+	for _, userConn := range userConnList {
+		if !userConn.Closed {
+			list = append(list, userConn)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ConnectTime != list[j].ConnectTime {
+			return list[i].ConnectTime > list[j].ConnectTime
+		}
+		return list[i].ID > list[j].ID
+	})
+	return
+}
+
+// 握手前检查，拒绝新链接的策略下已达到链接上限时返回错误
+func CheckLoginPolicy(userId int, platform string) (err error) {
+	limit := loginPolicyLimit()
+	if limit <= 0 || config.Settings.Websocket.LoginEvict != LoginEvictReject {
+		return
+	}
+
+	var list []*WsUserConnInfo
+	list, err = getOnlineUserConnList(userId)
+	if err != nil {
+		return
+	}
+
+	group := loginPolicyGroup(&WsUserConnInfo{Platform: platform})
+	var count int
+	for _, userConn := range list {
+		if loginPolicyGroup(userConn) == group {
+			count++
+		}
+	}
+	if count >= limit {
+		logger.Logger.Info("websocket login rejected by policy", zap.Int("user_id", userId), zap.String("platform", platform), zap.Int("count", count))
+		return errs.ErrWebSocketHaveOtherConnection
+	}
+	return
+}
+
+// 新链接注册后执行登录策略，每个分组只保留限制数量的链接，其余的链接通知客户端后关闭
+func (w *WsUserConnInfo) enforceLoginPolicy() {
+	limit := loginPolicyLimit()
+	if limit <= 0 {
+		return
+	}
+
+	lockKey := wsUserLoginLockPreCacheKey + strconv.Itoa(w.UID)
+	token, ok := waitLock(lockKey, 5, time.Second * 3)
+	if !ok {
+		logger.Logger.Warn("websocket login policy lock timeout", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID))
+		return
+	}
+	defer releaseLock(lockKey, token)
+
+	list, err := getOnlineUserConnList(w.UID)
+	if err != nil {
+		logger.Logger.Warn("websocket login policy get conn list failed", zap.Int("user_id", w.UID), zap.Error(err))
+		return
+	}
+
+	// 拒绝新链接的策略下并发登录超出限制时，保留最早的链接
+	if config.Settings.Websocket.LoginEvict == LoginEvictReject {
+		for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+			list[i], list[j] = list[j], list[i]
+		}
+	}
+
+	// 所有服务器按同样的排序计算保留的链接，同时登录时结果一致
+	reason := loginPolicyCloseReason()
+	var kept = make(map[string]int)
+	for _, userConn := range list {
+		group := loginPolicyGroup(userConn)
+		if kept[group] < limit {
+			kept[group]++
+			continue
+		}
+		logger.Logger.Info("websocket conn evicted by login policy", zap.Int("user_id", userConn.UID), zap.String("user_conn_id", userConn.ID), zap.String("policy", config.Settings.Websocket.LoginPolicy))
+		_ = CloseUserConn(userConn, reason)
+	}
+}
@@ -1,8 +1,9 @@
 package wsservice
 
 import (
-	"encoding/json"
+	"go-ws/config"
 	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
 	"go-ws/utils/logger"
 	"go-ws/utils/ws"
 	"go.uber.org/zap"
@@ -21,29 +22,72 @@ const (
 	WsUserConnInfoPreCacheKey = "ws_user_info:"
 )
 
+// 发送缓冲区满时的慢消费者处理策略
+const (
+	// 丢弃缓冲区中最旧的消息
+	SlowConsumerDropOldest = "drop_oldest"
+	// 丢弃新写入的消息
+	SlowConsumerDropNewest = "drop_newest"
+	// 断开链接
+	SlowConsumerDisconnect = "disconnect"
+)
+
 // 用户链接数据结构体
 type WsUserConnInfo struct {
 	ID  string `json:"id"`
 	UID int `json:"uid"`
 	Node string `json:"node"`
+	Instance string `json:"instance"` // 链接所在的服务实例
 	Closed         bool   `json:"closed"`
 	ConnectTime    int64  `json:"connect_time"`
 	DisConnectTime int64  `json:"disconnect_time"`
+	Codec          string `json:"codec"` // 链接协商的消息编码
+	Seq            int64  `json:"seq"`     // 链接最后推送的消息序号
+	AckSeq         int64  `json:"ack_seq"` // 客户端确认已收到的消息序号，断线重连时上报
+	DeliveredSeq   int64  `json:"delivered_seq"` // 客户端累计确认已收到的用户消息序号
+	ResumeToken    string `json:"-"`       // 断线重连token
+	DeviceId       string `json:"device_id"`   // 设备ID
+	Platform       string `json:"platform"`    // 平台，如ios、android、web
+	AppVersion     string `json:"app_version"` // 客户端版本
+	Locale         string `json:"locale"`      // 语言区域
+	UserAgent      string `json:"user_agent"`
 	wsConnection *ws.WsConnection
 	mu   sync.Mutex
-	messages chan []byte
+	// 按优先级分通道的发送缓冲区，由写协程统一写入链接
+	messages [msgPriorityLanes]chan wsFrame
+	// 写协程选择推送通道，只在写协程中使用
+	picker *priorityPicker
+	// 链接关闭通知
+	done chan struct{}
+	closeOnce sync.Once
+	// 发送给客户端的关闭原因
+	closeReason errs.CloseReason
+}
+
+// 发送缓冲区中的消息，保留原消息用于下线时重新入队
+type wsFrame struct {
+	data []byte
+	msg  *Msg
+	lane int
 }
 
 var (
 	AllWsUserConnInfos = make(map[string]*WsUserConnInfo)
+	allWsUserConnInfosMu sync.RWMutex
 	addWsUserConnInfos chan *WsUserConnInfo
 	delWsUserConnInfos chan *WsUserConnInfo
+	// 本机运行中的写协程，下线时等待推送完成
+	writePumpWg sync.WaitGroup
 )
 
 // 管理用户链接
 func ManagerWsUserConnInfos()  {
-	// 关闭原来的链接
-	CloseAllWsUserConn()
+	// 注册本实例，只回收宕机实例的链接，不影响其他服务器
+	StartNodeInstance()
+	// 启动本实例的消息分发
+	StartDispatcher()
+	// 启动定时推送
+	StartScheduler()
 
 	addWsUserConnInfos = make(chan *WsUserConnInfo)
 	delWsUserConnInfos = make(chan *WsUserConnInfo)
@@ -52,43 +96,76 @@ func ManagerWsUserConnInfos()  {
 		select {
 		case w := <- addWsUserConnInfos:
 			// 添加到本机的户链接的映射关系map
+			allWsUserConnInfosMu.Lock()
 			AllWsUserConnInfos[w.ID] = w
+			allWsUserConnInfosMu.Unlock()
 			// 更新用户链接信息
 			w.UpdateUserInfo()
+			// 保存断线重连token
+			SaveResumeToken(w.ResumeToken, w.ID, wsUserResumeTokenTTL)
 			// 添加用户ID
 			AddOnlineUserId(w.UID)
 			// 添加用户链接ID
 			AddWsUserConnId(w.UID, w.ID)
+			// 添加本实例的链接ID，实例宕机后由其他实例回收
+			AddNodeInstanceConnId(w.ID)
+			// 执行登录策略，踢出超出限制的链接
+			go w.enforceLoginPolicy()
+			// 先推送离线消息，再推送用户离线期间写入队列的消息
+			go func(w *WsUserConnInfo) {
+				w.FlushOfflineMsg()
+				_ = NotifyUserMsgReady(w.UID)
+			}(w)
 		case w := <- delWsUserConnInfos:
-			w.wsConnection.Close()
-
-			// 加锁，防止启动多个项目实例并发处理
-			w.mu.Lock()
-			if !w.Closed {
-				w.Closed = true
-				w.DisConnectTime = time.Now().Unix()
-
-				close(w.messages)
-				// 更新用户链接信息
-				w.UpdateUserInfo()
-				// 删除本机用户链接的映射关系map
-				DelLocalUserConn(w.ID)
-				// 删除用户链接信息
-				go w.DelUserInfo()
-
-			}
-			w.mu.Unlock()
+			go w.markClosed()
 		}
 	}
 }
 
+// 更新redis中的链接为关闭状态，并删除本机的链接
+func (w *WsUserConnInfo) markClosed() {
+	// 加锁，防止启动多个项目实例并发处理
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.Closed {
+		return
+	}
+
+	w.Closed = true
+	w.DisConnectTime = time.Now().Unix()
+
+	// 更新用户链接信息，链接已被断线重连接管时不更新
+	takenOver, _ := w.UpdateClosedUserInfo()
+	// 删除本机用户链接的映射关系map，断线重连可能已经用相同的链接ID注册了新链接
+	allWsUserConnInfosMu.Lock()
+	if AllWsUserConnInfos[w.ID] == w {
+		delete(AllWsUserConnInfos, w.ID)
+	}
+	allWsUserConnInfosMu.Unlock()
+	// 已被接管的链接ID属于新链接，不能删除新链接的数据，旧token已使用不再保存
+	if takenOver {
+		return
+	}
+	// 重连token只在宽限时间内有效
+	w.expireResumeToken()
+	// 删除本实例的链接ID
+	DelNodeInstanceConnId(w.ID)
+	// 删除用户链接信息
+	w.DelUserInfo()
+}
+
 // 更新用户信息
 func (w *WsUserConnInfo) UpdateUserInfo() (err error) {
 	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
 
 	cacheKey := WsUserConnInfoPreCacheKey + w.ID
 
-	_, err = rd.Do("hMSet", redis.Args{}.Add(cacheKey).AddFlat(w)...)
+	// 断线重连沿用旧链接ID，旧链接关闭时可能已设置过期时间
+	rd.Send("MULTI")
+	rd.Send("hMSet", redis.Args{}.Add(cacheKey).AddFlat(w)...)
+	rd.Send("persist", cacheKey)
+	_, err = rd.Do("EXEC")
 	if err != nil {
 		logger.Logger.Warn("update user info failed", zap.Any("user_info", w), zap.Error(err))
 		return
@@ -96,6 +173,31 @@ func (w *WsUserConnInfo) UpdateUserInfo() (err error) {
 	return
 }
 
+// 更新已关闭链接的信息，只有重连token一致时才更新，避免覆盖断线重连后的新链接，返回链接是否已被接管
+func (w *WsUserConnInfo) UpdateClosedUserInfo() (takenOver bool, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	luaScript := `
+	local token = redis.call('HGET', KEYS[1], 'ResumeToken')
+	if token and token ~= ARGV[1] then
+		return 0
+	end
+	redis.call('HMSET', KEYS[1], unpack(ARGV, 2))
+	return 1
+	`
+
+	script := redis.NewScript(1, luaScript)
+	cacheKey := WsUserConnInfoPreCacheKey + w.ID
+	var updated bool
+	updated, err = redis.Bool(script.Do(rd, redis.Args{}.Add(cacheKey, w.ResumeToken).AddFlat(w)...))
+	if err != nil {
+		logger.Logger.Warn("update closed user info failed", zap.Any("user_info", w), zap.Error(err))
+		return
+	}
+	return !updated, nil
+}
+
 // 删除用户数据，通过设置过期时间让redis自动删除,由于命令是单线程执行，这样避免过多del删除操作影响其他命令
 func (w *WsUserConnInfo) DelUserInfo() (err error) {
 	rd := myredis.NewRedis("default_redis").Get()
@@ -109,232 +211,246 @@ func (w *WsUserConnInfo) DelUserInfo() (err error) {
 	return
 }
 
-// 心跳检测
-func (w *WsUserConnInfo) HeartBeatCheck() {
-	defer func() {
-		delWsUserConnInfos <- w
-	}()
-	for {
-		select {
-		// 1秒没有消息就检测是否断连
-		case <- time.After(time.Millisecond * 10): 
-			if !w.wsConnection.IsConnect() {
-				logger.Logger.Warn("ping websocket user conn failed", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID))
+// 获取本机的用户链接
+func GetLocalUserConn(userConnId string) (w *WsUserConnInfo, ok bool) {
+	allWsUserConnInfosMu.RLock()
+	defer allWsUserConnInfosMu.RUnlock()
+	w, ok = AllWsUserConnInfos[userConnId]
+	return
+}
+
+// 关闭链接，通知写协程发送关闭原因，并交给管理协程清理链接数据
+func (w *WsUserConnInfo) Close(reason errs.CloseReason) {
+	w.closeOnce.Do(func() {
+		w.closeReason = reason
+		close(w.done)
+		go func() {
+			delWsUserConnInfos <- w
+		}()
+	})
+}
+
+// 消息写入发送缓冲区，不阻塞调用方，缓冲区满时按慢消费者策略处理
+func (w *WsUserConnInfo) Enqueue(data []byte, msg *Msg) (err error) {
+	frame := wsFrame{data: data, msg: msg, lane: msgLaneNormal}
+	if msg != nil {
+		frame.lane = msg.lane()
+	}
+	return w.enqueue(frame)
+}
+
+// 写入对应通道的发送缓冲区
+func (w *WsUserConnInfo) enqueue(frame wsFrame) (err error) {
+	messages := w.messages[frame.lane]
+	select {
+	case <-w.done:
+		return errs.ErrWebSocketConnectionClosed
+	case messages <- frame:
+		return
+	default:
+	}
+
+	switch config.Settings.Websocket.SlowConsumerPolicy {
+	case SlowConsumerDropNewest:
+		err = errs.ErrWebSocketSendBufferFull
+	case SlowConsumerDisconnect:
+		w.Close(errs.CloseSlowConsumer)
+		err = errs.ErrWebSocketSendBufferFull
+	default:
+		// 丢弃最旧的消息，直到新消息写入成功
+		for {
+			select {
+			case messages <- frame:
+				logger.Logger.Warn("websocket send buffer full, drop oldest msg", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID))
 				return
+			case <-w.done:
+				return errs.ErrWebSocketConnectionClosed
+			default:
+			}
+			select {
+			case <-messages:
+			default:
 			}
 		}
 	}
+
+	logger.Logger.Warn("websocket send buffer full", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.String("policy", config.Settings.Websocket.SlowConsumerPolicy), zap.Error(err))
+	return
 }
 
-// 循环推送队列消息给用户
-func (w *WsUserConnInfo) PushLoop() {
-	// 启动链接的时候检测是否有消息未成功推送
-	go w.MsgAckDelayCheck()
+// 链接是否已关闭
+func (w *WsUserConnInfo) IsClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
 
-	// 监听推送消息
-	for {
-		// 判断是否断开链接
-		if !w.wsConnection.IsConnect() {
-			logger.Logger.Warn("user websocket disconnect", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID))
-			break
-		}
+// 消息写入链接后记录状态
+func (w *WsUserConnInfo) delivered(frame wsFrame) {
+	if frame.msg != nil {
+		go frame.msg.UpdateMsgStatus(MsgStatusDelivered, w.ID, "")
+	}
+}
 
-		msg, err := PopWsMsgFromQueue(w.UID)
-		if err != nil {
-			time.Sleep(time.Second * 1)
-			continue
+// 按优先级取出发送缓冲区中的下一条消息，没有消息时返回false
+func (w *WsUserConnInfo) nextFrame() (frame wsFrame, ok bool) {
+	for _, lane := range w.picker.order() {
+		select {
+		case frame = <-w.messages[lane]:
+			w.picker.served(lane)
+			return frame, true
+		default:
 		}
+	}
+	return
+}
 
-		msg.ConnId = w.ID
+// 发送ping保持心跳
+func (w *WsUserConnInfo) ping() (err error) {
+	if err = w.wsConnection.Ping(); err != nil {
+		logger.Logger.Warn("ping websocket user conn failed", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.Error(err))
+	}
+	return
+}
 
-		// 向某个用户的所有链接同步推送消息
-		go func(userId int, msg Msg) {
-			var userConnIdList []WsUserConnInfo
-			userConnIdList, err = GetAllUserInfoList(userId)
-			if err != nil {
-				logger.Logger.Warn("get user all websocket conn id failed", zap.Int("user_id", userId), zap.Any("msg", msg), zap.Error(err))
+// 写协程，每个链接只有一个协程写入消息，并定时发送ping保持心跳，退出时发送关闭原因
+func (w *WsUserConnInfo) WritePump() {
+	ticker := time.NewTicker(time.Duration(config.Settings.Websocket.PingInterval) * time.Second)
+	defer func() {
+		ticker.Stop()
+		w.Close(errs.CloseConnectionLost)
+		// 服务下线时先推送完缓冲区的消息
+		if IsDraining() {
+			w.flush()
+		}
+		w.wsConnection.CloseWithReason(w.closeReason)
+		writePumpWg.Done()
+	}()
+	for {
+		// 持续有消息时也要保持心跳和响应关闭
+		select {
+		case <-ticker.C:
+			if w.ping() != nil {
 				return
 			}
+			continue
+		case <-w.done:
+			return
+		default:
+		}
 
-			for _, userConn := range userConnIdList {
-				if userConn.Closed {
-					continue
-				}
-				if _, ok := AllWsUserConnInfos[userConn.ID]; ok {
-					go msg.PushMsg(userConn.ID)
-				} else {
-					go msg.PushMsgToOtherServer(userConn.Node, userConn.ID)
-				}
-
-				// 记录消息到延迟队列，判断用户是否收到消息ACK
-				if msg.Retries > 0 {
-					msg.ConnId = userConn.ID
-					go msg.PushWsMsgToDelayQueue()
+		frame, ok := w.nextFrame()
+		if !ok {
+			// 缓冲区为空时等待任意通道的新消息
+			select {
+			case frame = <-w.messages[msgLaneHigh]:
+			case frame = <-w.messages[msgLaneNormal]:
+			case frame = <-w.messages[msgLaneLow]:
+			case <-ticker.C:
+				if w.ping() != nil {
+					return
 				}
+				continue
+			case <-w.done:
+				return
 			}
-
-		}(w.UID, msg)
-
-		logger.Logger.Info("send websocket msg success", zap.Int("user_id", w.UID), zap.Any("msg", msg), zap.String("user_conn_id", w.ID))
+			w.picker.served(frame.lane)
+		}
+		if err := w.wsConnection.Send(frame.data); err != nil {
+			logger.Logger.Warn("write websocket msg failed", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.Error(err))
+			return
+		}
+		w.delivered(frame)
 	}
 }
 
-// 循环接受发送给用户的消息
+// 循环接受发送给用户的消息，读取失败或pong超时时关闭链接
 func (w *WsUserConnInfo) ReceiveLoop() {
-	for {
-		// 判断是否断开链接
-		if !w.wsConnection.IsConnect() {
-			break
-		}
+	defer w.Close(errs.CloseConnectionLost)
 
-		recMsgStr, err := w.wsConnection.Read()
+	w.wsConnection.SetPongWait(time.Duration(config.Settings.Websocket.PongWait) * time.Second)
+	for {
+		data, err := w.wsConnection.Read()
 		if err != nil {
 			logger.Logger.Warn("receive websocket msg failed", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.Error(err))
-			continue
+			return
 		}
 
 		var recMsg RecMsg
-		if err = json.Unmarshal([]byte(recMsgStr), recMsg); err != nil {
-			logger.Logger.Warn("receive websocket msg json unmarshal failed", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.String("receive_msg", recMsgStr), zap.Error(err))
+		if err = w.wsConnection.Codec.Unmarshal(data, &recMsg); err != nil {
+			logger.Logger.Warn("receive websocket msg decode failed", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.String("codec", w.Codec), zap.Binary("receive_msg", data), zap.Error(err))
 			continue
 		}
 
-		if recMsg.ID != "" {
-			// 保存消息的ack
-			_ = AddMsgAck(w.UID, recMsg.ID, w.ID)
+		switch {
+		case recMsg.Type == RecMsgTypeSync:
+			// 客户端发现序号不连续，请求补齐缺失的消息
+			go w.SyncMsg(recMsg.From, recMsg.To)
+		default:
+			// 客户端确认已收到、已读或已忽略
+			go w.HandleAck(recMsg)
 		}
 
-		logger.Logger.Info("receive websocket msg success", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.String("receive_msg", recMsgStr), zap.Error(err))
+		logger.Logger.Info("receive websocket msg success", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.Any("receive_msg", recMsg))
 
 	}
 }
 
-// 消息延迟检测ACK
-func (w *WsUserConnInfo) MsgAckDelayCheck() {
-	for {
-		if !w.wsConnection.IsConnect() {
-			logger.Logger.Warn("delay check websocket user disconnect failed", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID))
-			break
-		}
-
-		msg, err := PopWsMsgFromDelayQueue(w.UID)
-		if err != nil {
-			time.Sleep(time.Second * 1)
-			continue
-		}
-
-		// 判断之前发送的客户端有收到ACK，删除ACK记录，如没有收到消息的ACK记录会返回nil报错
-		_, err = GetMsgAck(w.UID, msg.ID, w.ID)
-		if err == nil {
-			go DelMsgAck(w.UID, msg.ID, w.ID)
-			continue
-		}
 
-		// 没有收到ACK，就再发一次
-		if userConn, ok := AllWsUserConnInfos[msg.ConnId]; ok {
-			if msg.Retries > 0 {
-				msg.Retries = msg.Retries - 1
-				_ = msg.PushMsg(userConn.ID)
-				// 记录消息到延迟队列，判断用户是否收到消息ACK
-				go msg.PushWsMsgToDelayQueue()
-			}
-		} else {
-			// 查找客户端
-			if userConn, err := GetWsUserConnInfo(userConn.ID); err != nil {
-				if userConn.Closed == false {
-					continue
-				}
-				if msg.Retries > 0 {
-					msg.Retries = msg.Retries - 1
-					go msg.PushMsgToOtherServer(userConn.Node, userConn.ID)
-					// 记录消息到延迟队列，判断用户是否收到消息ACK
-					go msg.PushWsMsgToDelayQueue()
-				}
-			}
-		}
-		
-	}
+// 添加用户链接信息
+func AddWsUserConnInfo(userId int, node string, w *ws.WsConnection) *WsUserConnInfo {
+	u := NewWsUserConnInfo(userId, node, w)
+	u.Register()
+	return u
 }
 
-
-// 添加用户链接信息
-func AddWsUserConnInfo(userId int, node string, w *ws.WsConnection) WsUserConnInfo {
-	u := WsUserConnInfo{
+// 创建用户链接信息，调用Register后才添加到本机
+func NewWsUserConnInfo(userId int, node string, w *ws.WsConnection) *WsUserConnInfo {
+	u := &WsUserConnInfo{
 		ID:             w.ID,
 		UID:            userId,
 		Node:           node,
+		Instance:       LocalInstance(),
 		Closed:         false,
 		ConnectTime:    time.Now().Unix(),
 		DisConnectTime: 0,
+		Codec:          w.Codec.Name(),
+		ResumeToken:    NewResumeToken(),
 		wsConnection:   w,
-		messages:       make(chan []byte, 1000),
+		picker:         newPriorityPicker(),
+		done:           make(chan struct{}),
+	}
+	for lane := range u.messages {
+		u.messages[lane] = make(chan wsFrame, sendBufferSize(lane))
 	}
-
-	logger.Logger.Info("add websocket user info success", zap.Int("user_id", userId), zap.String("user_conn_id", w.ID), zap.String("node", node))
-
-	addWsUserConnInfos <- &u
 	return u
 }
 
-// 关闭所有客户端的链接
-func CloseAllWsUserConn() (err error) {
-	var onlineUserIdList []int
-	// 获取用户ID列表
-	onlineUserIdList, err = GetOnLineUserIdList()
-	if err != nil {
-		logger.Logger.Warn("get websocket user list failed", zap.Error(err))
-		return
+// 各优先级通道的发送缓冲区大小，只有普通通道使用完整的缓冲区
+func sendBufferSize(lane int) int {
+	switch lane {
+	case msgLaneHigh:
+		return config.Settings.Websocket.SendBufferHighSize
+	case msgLaneLow:
+		return config.Settings.Websocket.SendBufferLowSize
 	}
+	return config.Settings.Websocket.SendBufferSize
+}
 
-	for _, onlineUserId := range onlineUserIdList {
-		var userConnIdList []string
-		// 获取用户链接ID列表
-		userConnIdList, err = GetWsUserConnIdList(onlineUserId)
-		if err != nil {
-			logger.Logger.Warn("get online user id list failed", zap.Int("user_id", onlineUserId), zap.Error(err))
-			continue
-		}
-
-		for _, userConnId := range userConnIdList {
-			go func(onlineUserId int, userConnId string) {
-				var w WsUserConnInfo
-				// 获取用户信息
-				w, err = GetWsUserConnInfo(userConnId)
-				if err != nil {
-					// 查不到时删除列表里的clientID
-					if err == redis.ErrNil {
-						// 删除用户链接ID
-						go DelWsUserConnId(onlineUserId, userConnId)
-					}
-					return
-				}
-
-				// 设置redis中连接为关闭状态
-				if w.Closed == false {
-					w.Closed = true
-					w.DisConnectTime = time.Now().Unix()
-					// 更新用户链接信息
-					w.UpdateUserInfo()
-					// 删除用户链接信息
-					go w.DelUserInfo()
-				}
-
-				// 删除已关闭7天的连接
-				if w.DisConnectTime <= time.Now().AddDate(0, 0, -7).Unix() {
-					// 删除用户链接ID
-					DelWsUserConnId(onlineUserId, userConnId)
-				}
-
-			}(onlineUserId, userConnId)
-		}
-
-	}
+// 添加到本机的用户链接
+func (w *WsUserConnInfo) Register() {
+	logger.Logger.Info("add websocket user info success", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.String("node", w.Node))
 
-	return
+	// 注册后由调用方启动写协程
+	writePumpWg.Add(1)
+	addWsUserConnInfos <- w
 }
 
 // 获取用户链接数据
-func GetWsUserConnInfo(userConnId string) (w WsUserConnInfo, err error) {
+func GetWsUserConnInfo(userConnId string) (w *WsUserConnInfo, err error) {
 	rd := myredis.NewRedis("default_redis").Get()
 
 	cacheKey := WsUserConnInfoPreCacheKey + userConnId
@@ -345,7 +461,14 @@ func GetWsUserConnInfo(userConnId string) (w WsUserConnInfo, err error) {
 		return
 	}
 
-	err = redis.ScanStruct(v, &w)
+	// 链接数据已过期
+	if len(v) == 0 {
+		err = redis.ErrNil
+		return
+	}
+
+	w = &WsUserConnInfo{}
+	err = redis.ScanStruct(v, w)
 	if err != nil {
 		logger.Logger.Warn("scan websocket user info failed", zap.String("user_conn_id", userConnId), zap.Any("user_info", v), zap.Error(err))
 		return
@@ -355,7 +478,7 @@ func GetWsUserConnInfo(userConnId string) (w WsUserConnInfo, err error) {
 }
 
 // 获取某个用户的所有链接信息，推送用户消息
-func GetAllUserInfoList(userId int) (w []WsUserConnInfo, err error) {
+func GetAllUserInfoList(userId int) (w []*WsUserConnInfo, err error) {
 	var userConnIdList []string
 	userConnIdList, err = GetWsUserConnIdList(userId)
 	if err != nil {
@@ -364,16 +487,21 @@ func GetAllUserInfoList(userId int) (w []WsUserConnInfo, err error) {
 	}
 
 	var wg sync.WaitGroup
-	var ch = make(chan WsUserConnInfo, len(userConnIdList))
+	var ch = make(chan *WsUserConnInfo, len(userConnIdList))
 
 	for _, userConnId := range userConnIdList {
 		wg.Add(1)
 
 		go func(userConnId string) {
 			defer wg.Done()
-			if w, err := GetWsUserConnInfo(userConnId); err == nil {
-
+			w, err := GetWsUserConnInfo(userConnId)
+			if err == nil {
 				ch <- w
+				return
+			}
+			// 链接数据已过期时删除列表里的链接ID
+			if err == redis.ErrNil {
+				DelWsUserConnId(userId, userConnId)
 			}
 		}(userConnId)
 	}
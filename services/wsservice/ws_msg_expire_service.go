@@ -0,0 +1,100 @@
+package wsservice
+
+import (
+	"github.com/gomodule/redigo/redis"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+const (
+	// 用户消息的合并key，值为该key最新的消息ID
+	msgCollapsePreCacheKey = "ws_user_msg_collapse:"
+)
+
+// 消息失效的原因
+const (
+	// 超过过期时间
+	MsgExpiredReasonTTL = "ttl"
+	// 被相同合并key的新消息替换
+	MsgExpiredReasonCollapsed = "collapsed"
+)
+
+// 消息是否已过期，未设置过期时间的消息不过期
+func (m Msg) IsExpired() bool {
+	return m.ExpiresAt > 0 && m.ExpiresAt <= time.Now().Unix()
+}
+
+// 设置从now开始的有效时长(s)，与已设置的过期时间同时存在时以较早的为准
+func (m *Msg) SetTtl(now, ttl int64) {
+	if ttl <= 0 {
+		return
+	}
+	if expiresAt := now + ttl; m.ExpiresAt == 0 || expiresAt < m.ExpiresAt {
+		m.ExpiresAt = expiresAt
+	}
+}
+
+// 是否已有相同合并key的新消息
+func (m Msg) isCollapsed() bool {
+	if m.CollapseKey == "" {
+		return false
+	}
+
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	latest, err := redis.String(rd.Do("hGet", msgCollapsePreCacheKey+strconv.Itoa(m.UID), m.CollapseKey))
+	if err != nil {
+		return false
+	}
+	return latest != m.ID
+}
+
+// 消息失效的原因，未失效时返回空
+func (m Msg) staleReason() string {
+	if m.IsExpired() {
+		return MsgExpiredReasonTTL
+	}
+	if m.isCollapsed() {
+		return MsgExpiredReasonCollapsed
+	}
+	return ""
+}
+
+// 丢弃已失效的消息并记录状态，返回是否已丢弃
+func (m Msg) dropStale() bool {
+	reason := m.staleReason()
+	if reason == "" {
+		return false
+	}
+
+	go m.UpdateMsgStatus(MsgStatusExpired, "", reason)
+	logger.Logger.Info("drop stale websocket msg", zap.Int("user_id", m.UID), zap.Any("msg", m), zap.String("reason", reason))
+	return true
+}
+
+// 消息推送后删除合并key，只删除自己写入的
+func (m Msg) releaseCollapseKey() {
+	if m.CollapseKey == "" {
+		return
+	}
+
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	luaScript := `
+	if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+		return redis.call('HDEL', KEYS[1], ARGV[1])
+	end
+	return 0
+	`
+
+	script := redis.NewScript(1, luaScript)
+	_, err := script.Do(rd, msgCollapsePreCacheKey+strconv.Itoa(m.UID), m.CollapseKey, m.ID)
+	if err != nil {
+		logger.Logger.Warn("release websocket msg collapse key failed", zap.Int("user_id", m.UID), zap.String("collapse_key", m.CollapseKey), zap.Error(err))
+	}
+}
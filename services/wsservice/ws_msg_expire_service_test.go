@@ -0,0 +1,23 @@
+package wsservice
+
+import "testing"
+
+func TestMsgSetTtl(t *testing.T) {
+	tests := []struct {
+		expiresAt int64
+		ttl       int64
+		want      int64
+	}{
+		{0, 0, 0},
+		{0, 60, 1060},
+		{1030, 60, 1030},
+		{2000, 60, 1060},
+	}
+	for _, tt := range tests {
+		msg := Msg{ExpiresAt: tt.expiresAt}
+		msg.SetTtl(1000, tt.ttl)
+		if msg.ExpiresAt != tt.want {
+			t.Errorf("expires_at %d SetTtl(1000, %d) = %d, want %d", tt.expiresAt, tt.ttl, msg.ExpiresAt, tt.want)
+		}
+	}
+}
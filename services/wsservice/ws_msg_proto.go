@@ -0,0 +1,113 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"go-ws/utils/codec"
+	"io"
+)
+
+// 消息内容转为protobuf的string字段，非字符串内容使用json编码
+func protoContent(content interface{}) string {
+	switch c := content.(type) {
+	case nil:
+		return ""
+	case string:
+		return c
+	case []byte:
+		return string(c)
+	}
+	data, _ := json.Marshal(content)
+	return string(data)
+}
+
+// protobuf编码，字段定义见ws.proto
+func (m Msg) MarshalProto() ([]byte, error) {
+	var w codec.ProtoWriter
+	w.String(1, m.ID)
+	w.Int(2, int64(m.UID))
+	w.String(3, protoContent(m.Content))
+	w.Int(4, int64(m.Retries))
+	w.String(5, m.ConnId)
+	w.Int(6, m.ConnSeq)
+	w.Int(7, m.Seq)
+	w.String(8, m.Type)
+	w.Int(9, int64(m.From))
+	w.Int(10, int64(m.Priority))
+	return w.Result(), nil
+}
+
+// protobuf解码
+func (m *Msg) UnmarshalProto(data []byte) error {
+	r := codec.NewProtoReader(data)
+	for {
+		field, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			m.ID = r.String()
+		case 2:
+			m.UID = int(r.Int())
+		case 3:
+			m.Content = r.String()
+		case 4:
+			m.Retries = int(r.Int())
+		case 5:
+			m.ConnId = r.String()
+		case 6:
+			m.ConnSeq = r.Int()
+		case 7:
+			m.Seq = r.Int()
+		case 8:
+			m.Type = r.String()
+		case 9:
+			m.From = int(r.Int())
+		case 10:
+			m.Priority = int(r.Int())
+		}
+	}
+}
+
+// protobuf编码，字段定义见ws.proto
+func (m RecMsg) MarshalProto() ([]byte, error) {
+	var w codec.ProtoWriter
+	w.String(1, m.ID)
+	w.String(2, protoContent(m.Content))
+	w.String(3, m.Type)
+	w.Int(4, m.From)
+	w.Int(5, m.To)
+	w.Int(6, m.Seq)
+	return w.Result(), nil
+}
+
+// protobuf解码
+func (m *RecMsg) UnmarshalProto(data []byte) error {
+	r := codec.NewProtoReader(data)
+	for {
+		field, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			m.ID = r.String()
+		case 2:
+			m.Content = r.String()
+		case 3:
+			m.Type = r.String()
+		case 4:
+			m.From = r.Int()
+		case 5:
+			m.To = r.Int()
+		case 6:
+			m.Seq = r.Int()
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package wsservice
+
+import (
+	"go-ws/utils/codec"
+	"reflect"
+	"testing"
+)
+
+func TestMsgProtoRoundTrip(t *testing.T) {
+	msgs := []Msg{
+		{ID: "1", UID: 100, Content: "hello", Retries: 2, ConnId: "c1", ConnSeq: 3, Seq: 10, Type: "receipt", From: 200, Priority: -1},
+		{ID: "2", UID: 100, Content: "hi"},
+	}
+	c := codec.ProtobufCodec{}
+	for _, msg := range msgs {
+		data, err := c.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Msg
+		if err = c.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("round trip = %+v, want %+v", got, msg)
+		}
+	}
+}
+
+// 非字符串的内容按json编码为字符串
+func TestMsgProtoContent(t *testing.T) {
+	msg := Msg{ID: "1", Content: SessionInfo{ConnId: "c1", ResumeToken: "t1"}}
+	data, err := msg.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Msg
+	if err = got.UnmarshalProto(data); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"conn_id":"c1","resume_token":"t1","resumed":false}`; got.Content != want {
+		t.Fatalf("content = %v, want %s", got.Content, want)
+	}
+}
+
+func TestRecMsgProtoRoundTrip(t *testing.T) {
+	msg := RecMsg{ID: "1", Content: "ok", Type: RecMsgTypeSync, From: 5, To: 10, Seq: 4}
+	c := codec.ProtobufCodec{}
+	data, err := c.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got RecMsg
+	if err = c.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Fatalf("round trip = %+v, want %+v", got, msg)
+	}
+}
@@ -0,0 +1,246 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+// 撤回和编辑事件的消息类型，推送给已收到原消息的链接
+const (
+	// 撤回消息
+	MsgTypeRecall = "recall"
+	// 编辑消息
+	MsgTypeEdit = "edit"
+)
+
+// 撤回或编辑的结果
+type MsgRevision struct {
+	ID      string   `json:"id"`
+	Action  string   `json:"action"`
+	Queued  bool     `json:"queued"`   // 消息还未推送，已从队列中删除或替换
+	ConnIds []string `json:"conn_ids"` // 消息已推送，已向这些链接推送撤回或编辑事件
+}
+
+// 撤回或编辑事件的内容
+type MsgRevisionEvent struct {
+	MsgId   string      `json:"msg_id"`
+	Content interface{} `json:"content,omitempty"` // 编辑后的内容
+}
+
+// 按消息ID替换或删除有序集合中的消息，编辑后的内容为空时删除，返回找到的记录数
+// 同一消息可能有多条记录，如发给多个链接的延迟消息
+var reviseStoredMsgScript = redis.NewScript(1, `
+	local count = 0
+	local messages = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+	for i = 1, #messages, 2 do
+		local ok, msg = pcall(cjson.decode, messages[i])
+		if ok and msg['id'] == ARGV[1] then
+			count = count + 1
+			redis.call('ZREM', KEYS[1], messages[i])
+			if ARGV[2] ~= '' then
+				msg['content'] = cjson.decode(ARGV[2])
+				redis.call('ZADD', KEYS[1], messages[i + 1], cjson.encode(msg))
+			end
+		end
+	end
+	return count
+	`)
+
+// 按消息ID替换或删除用户各通道队列中还未读取的消息，编辑后的内容为空时删除，返回找到的记录数
+// stream中消费组最后读取的消息之后为未读取的消息，消费组不存在时都未读取
+// stream中的消息不能原地替换，编辑后的内容保存到第二个key，读取时替换，保持消息在队列中的位置
+// 第一个key为队列长度统计，删除后同时更新用户的队列长度
+var reviseQueuedMsgScript = redis.NewScript(2+msgPriorityLanes, `
+	local stream = ARGV[1] == 'stream'
+	local function revise(message)
+		local ok, msg = pcall(cjson.decode, message)
+		if not ok or msg['id'] ~= ARGV[2] then
+			return nil
+		end
+		if ARGV[3] == '' then
+			return ''
+		end
+		msg['content'] = cjson.decode(ARGV[3])
+		return cjson.encode(msg)
+	end
+
+	local function reviseList(key)
+		local count = 0
+		-- 删除时先替换为占位再统一删除，避免下标变化
+		local tombstone = 'recalled:' .. ARGV[2]
+		for i, message in ipairs(redis.call('LRANGE', key, 0, -1)) do
+			local revised = revise(message)
+			if revised then
+				count = count + 1
+				if revised == '' then
+					revised = tombstone
+				end
+				redis.call('LSET', key, i - 1, revised)
+			end
+		end
+		if ARGV[3] == '' and count > 0 then
+			redis.call('LREM', key, 0, tombstone)
+		end
+		return count
+	end
+
+	local function reviseStream(key)
+		local start = '-'
+		if redis.call('EXISTS', key) == 1 then
+			for _, group in ipairs(redis.call('XINFO', 'GROUPS', key)) do
+				local name, lastId
+				for i = 1, #group, 2 do
+					if group[i] == 'name' then
+						name = group[i + 1]
+					elseif group[i] == 'last-delivered-id' then
+						lastId = group[i + 1]
+					end
+				end
+				if name == ARGV[4] then
+					start = lastId
+				end
+			end
+		end
+
+		local count = 0
+		for _, entry in ipairs(redis.call('XRANGE', key, start, '+')) do
+			if entry[1] ~= start then
+				local revised = revise(entry[2][2])
+				if revised then
+					count = count + 1
+					if revised == '' then
+						redis.call('XDEL', key, entry[1])
+					else
+						redis.call('HSET', KEYS[2], ARGV[2], ARGV[3])
+						redis.call('EXPIRE', KEYS[2], ARGV[6])
+					end
+				end
+			end
+		end
+		return count
+	end
+
+	local count, total = 0, 0
+	for i = 3, #KEYS do
+		if stream then
+			count = count + reviseStream(KEYS[i])
+			total = total + redis.call('XLEN', KEYS[i])
+		else
+			count = count + reviseList(KEYS[i])
+			total = total + redis.call('LLEN', KEYS[i])
+		end
+	end
+	if count > 0 and ARGV[3] == '' then
+		redis.call('HDEL', KEYS[2], ARGV[2])
+		if total > 0 then
+			redis.call('ZADD', KEYS[1], total, ARGV[5])
+		else
+			redis.call('ZREM', KEYS[1], ARGV[5])
+		end
+	end
+	return count
+	`)
+
+// 撤回消息，还未推送的从队列中删除，已推送的通知收到的链接
+func RecallMsg(userId int, msgId string) (MsgRevision, error) {
+	return reviseMsg(userId, msgId, MsgTypeRecall, nil)
+}
+
+// 编辑消息，还未推送的替换队列中的内容，已推送的通知收到的链接
+func EditMsg(userId int, msgId string, content interface{}) (MsgRevision, error) {
+	return reviseMsg(userId, msgId, MsgTypeEdit, content)
+}
+
+func reviseMsg(userId int, msgId, action string, content interface{}) (result MsgRevision, err error) {
+	result = MsgRevision{ID: msgId, Action: action, ConnIds: []string{}}
+	recall := action == MsgTypeRecall
+	// 编辑后的内容，撤回时为空
+	var revised string
+	if !recall {
+		data, _ := json.Marshal(content)
+		revised = string(data)
+	}
+
+	// 消息ID由调用方指定，只能修改属于该用户的消息
+	status, statusErr := GetMsgStatus(msgId)
+	if statusErr == nil && status.UID != userId {
+		return result, errs.ErrMsgNotFound
+	}
+
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	uid := strconv.Itoa(userId)
+	// 待推送的消息队列
+	result.Queued = reviseQueuedMsg(rd, userId, msgId, revised)
+	// 等待重试和离线的消息
+	result.Queued = reviseStoredMsg(rd, msgDelayQueuePreCacheKey+uid, msgId, revised) || result.Queued
+	result.Queued = reviseStoredMsg(rd, msgOfflinePreCacheKey+uid, msgId, revised) || result.Queued
+	// 消息记录，客户端补齐时不再推送撤回的消息
+	reviseStoredMsg(rd, msgLogPreCacheKey+uid, msgId, revised)
+
+	// 按状态记录查找已分发和已写入的链接，已分发的消息可能还在链接的发送缓冲区
+	if statusErr != nil && !result.Queued {
+		return result, errs.ErrMsgNotFound
+	}
+	if statusErr == nil {
+		seen := make(map[string]bool)
+		for _, event := range status.History {
+			if (event.State == MsgStatusDispatched || event.State == MsgStatusDelivered) && event.ConnId != "" && !seen[event.ConnId] {
+				seen[event.ConnId] = true
+				result.ConnIds = append(result.ConnIds, event.ConnId)
+			}
+		}
+	}
+
+	if len(result.ConnIds) > 0 {
+		event := Msg{
+			ID:       NewMsgId(),
+			UID:      userId,
+			Type:     action,
+			Priority: MsgPriorityHigh,
+			Include:  &ConnFilter{ConnIds: result.ConnIds},
+			Content:  MsgRevisionEvent{MsgId: msgId, Content: content},
+		}
+		if err = event.PushWsMsgToQueue(); err != nil {
+			return
+		}
+	}
+
+	state := MsgStatusEdited
+	if recall {
+		state = MsgStatusRecalled
+	}
+	_ = Msg{ID: msgId, UID: userId}.UpdateMsgStatus(state, "", "")
+
+	logger.Logger.Info("revise websocket msg success", zap.Int("user_id", userId), zap.Any("result", result))
+	return
+}
+
+// 替换或删除有序集合中指定ID的消息，revised为空时删除，返回是否找到
+func reviseStoredMsg(rd redis.Conn, cacheKey, msgId, revised string) (found bool) {
+	n, err := redis.Int(reviseStoredMsgScript.Do(rd, cacheKey, msgId, revised))
+	if err != nil {
+		logger.Logger.Warn("revise websocket msg failed", zap.String("cacheKey", cacheKey), zap.String("msg_id", msgId), zap.Error(err))
+		return
+	}
+	return n > 0
+}
+
+// 替换或删除用户队列中还未读取的消息，revised为空时删除，返回是否找到
+func reviseQueuedMsg(rd redis.Conn, userId int, msgId, revised string) bool {
+	args := redis.Args{}.Add(msgQueueDepthKey, msgStreamEditPreCacheKey+strconv.Itoa(userId)).Add(userQueueKeys(userId)...).
+		Add(config.Settings.Websocket.InboxBackend, msgId, revised, msgStreamGroup, userId, config.Settings.Websocket.MsgLogTTL)
+	n, err := redis.Int(reviseQueuedMsgScript.Do(rd, args...))
+	if err != nil {
+		logger.Logger.Warn("revise websocket queued msg failed", zap.Int("user_id", userId), zap.String("msg_id", msgId), zap.Error(err))
+		return false
+	}
+	return n > 0
+}
@@ -0,0 +1,312 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+const (
+	// 用户消息序号
+	msgSeqPreCacheKey = "ws_user_msg_seq:"
+	// 用户最近的消息记录，按序号排序，用于客户端补齐缺失的消息
+	msgLogPreCacheKey = "ws_user_msg_log:"
+	// 推送消息的分发锁，同一用户的消息同一时间只由一个实例分发，保证推送顺序
+	msgDispatchLockPreCacheKey = "ws_user_msg_dispatch_lock:"
+)
+
+// 客户端发送的消息类型
+const (
+	// 请求补齐序号范围内的消息
+	RecMsgTypeSync = "sync"
+)
+
+// 消息写入用户的消息队列，所有入队都经过该脚本，保证用户队列的上限和长度统计
+// 新消息分配序号并写入消息记录，重新入队的消息保留原序号
+// 超出上限时删除所有通道中序号最小的消息并释放其合并key，拒绝写入时返回的序号为0
+// 重推死信消息时写入和删除死信在同一脚本中完成，死信已不存在时返回的序号为-1
+var enqueueWsMsgScript = redis.NewScript(6+msgPriorityLanes, `
+	local msg = cjson.decode(ARGV[1])
+	local stream = ARGV[5] == 'stream'
+	local max = tonumber(ARGV[6])
+	local replay = ARGV[10] == '1'
+	local first, last = 7, 6 + `+strconv.Itoa(msgPriorityLanes)+`
+
+	if replay and redis.call('HEXISTS', KEYS[6], msg['id']) == 0 then
+		return {-1}
+	end
+
+	local function queueLen(key)
+		if stream then
+			return redis.call('XLEN', key)
+		end
+		return redis.call('LLEN', key)
+	end
+	-- 通道中最旧的消息，返回消息内容和stream消息ID
+	local function head(key)
+		if stream then
+			local entries = redis.call('XRANGE', key, '-', '+', 'COUNT', 1)
+			if #entries > 0 then
+				return entries[1][2][2], entries[1][1]
+			end
+			return nil
+		end
+		return redis.call('LINDEX', key, 0)
+	end
+
+	local total = 0
+	for i = first, last do
+		total = total + queueLen(KEYS[i])
+	end
+	if max > 0 and total >= max and ARGV[7] == 'reject' then
+		return {0}
+	end
+
+	local seq = tonumber(msg['seq']) or 0
+	if ARGV[9] == '1' then
+		seq = redis.call('INCR', KEYS[1])
+		msg['seq'] = seq
+	end
+	local message = cjson.encode(msg)
+	if ARGV[9] == '1' then
+		redis.call('ZADD', KEYS[2], seq, message)
+		redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -tonumber(ARGV[3]) - 1)
+		redis.call('EXPIRE', KEYS[2], ARGV[4])
+		if type(msg['collapse_key']) == 'string' and msg['collapse_key'] ~= '' then
+			redis.call('HSET', KEYS[4], msg['collapse_key'], msg['id'])
+			redis.call('EXPIRE', KEYS[4], ARGV[4])
+		end
+	end
+
+	local queue = KEYS[first + tonumber(ARGV[8])]
+	if stream then
+		redis.call('XADD', queue, '*', 'msg', message)
+	else
+		redis.call('RPUSH', queue, message)
+	end
+	total = total + 1
+	if replay then
+		redis.call('HDEL', KEYS[6], msg['id'])
+	end
+
+	local result = {seq}
+	while max > 0 and total > max do
+		local oldest, oldestKey, oldestId, oldestSeq
+		for i = first, last do
+			local data, id = head(KEYS[i])
+			if data then
+				local ok, m = pcall(cjson.decode, data)
+				local s = ok and tonumber(m['seq']) or 0
+				if not oldest or s < oldestSeq then
+					oldest, oldestKey, oldestId, oldestSeq = data, KEYS[i], id, s
+				end
+			end
+		end
+		if not oldest then
+			break
+		end
+		if stream then
+			redis.call('XDEL', oldestKey, oldestId)
+		else
+			redis.call('LPOP', oldestKey)
+		end
+		total = total - 1
+		table.insert(result, oldest)
+
+		local ok, m = pcall(cjson.decode, oldest)
+		if ok and type(m['collapse_key']) == 'string' and m['collapse_key'] ~= '' and redis.call('HGET', KEYS[4], m['collapse_key']) == m['id'] then
+			redis.call('HDEL', KEYS[4], m['collapse_key'])
+		end
+	end
+
+	if total > 0 then
+		redis.call('ZADD', KEYS[5], total, ARGV[2])
+	else
+		redis.call('ZREM', KEYS[5], ARGV[2])
+	end
+	redis.call('RPUSH', KEYS[3], ARGV[2])
+	return result
+	`)
+
+// 用户消息写入的队列，按优先级写入对应的通道
+func (m *Msg) queueKey() string {
+	return laneQueueKey(queuePreCacheKey(), m.UID, m.lane())
+}
+
+// 用户消息队列的key前缀
+func queuePreCacheKey() string {
+	if useStreamInbox() {
+		return msgStreamPreCacheKey
+	}
+	return msgQueuePreCacheKey
+}
+
+// 用户所有通道的队列key
+func userQueueKeys(userId int) (cacheKeys []interface{}) {
+	for lane := 0; lane < msgPriorityLanes; lane++ {
+		cacheKeys = append(cacheKeys, laneQueueKey(queuePreCacheKey(), userId, lane))
+	}
+	return
+}
+
+// 入队脚本的参数，replay为true时同时删除该消息的死信
+func (m *Msg) enqueueArgs(replay bool) redis.Args {
+	var data []byte
+	data, _ = json.Marshal(m)
+
+	assignSeq := "0"
+	if m.Seq == 0 {
+		assignSeq = "1"
+	}
+	replayFlag := "0"
+	if replay {
+		replayFlag = "1"
+	}
+	uid := strconv.Itoa(m.UID)
+	return redis.Args{}.Add(msgSeqPreCacheKey+uid, msgLogPreCacheKey+uid, msgReadyListKey, msgCollapsePreCacheKey+uid, msgQueueDepthKey, msgDeadLetterPreCacheKey+uid).
+		Add(userQueueKeys(m.UID)...).
+		Add(string(data), m.UID, config.Settings.Websocket.MsgLogSize, config.Settings.Websocket.MsgLogTTL,
+			config.Settings.Websocket.InboxBackend, queueMaxSize(), config.Settings.Websocket.QueueFullPolicy, m.lane(), assignSeq, replayFlag)
+}
+
+// 用户所有通道的最大消息总数，0为不限制，使用stream存储时不超过inbox_stream_max_len
+// 写入前按队列已满的策略处理，不裁剪stream，避免删除还未读取或未确认的消息
+func queueMaxSize() int {
+	max := config.Settings.Websocket.QueueMaxSize
+	if useStreamInbox() && (max == 0 || max > config.Settings.Websocket.InboxStreamMaxLen) {
+		max = config.Settings.Websocket.InboxStreamMaxLen
+	}
+	return max
+}
+
+// 解析入队结果，队列已满时返回ErrMsgQueueFull，超出上限被删除的旧消息记录状态
+func (m *Msg) enqueueResult(reply interface{}, err error) error {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return errs.ErrPushMsgToQueueFailed
+	}
+	var seq int64
+	if seq, err = redis.Int64(values[0], nil); err != nil {
+		return err
+	}
+	if seq < 0 {
+		return errs.ErrDeadLetterNotFound
+	}
+	if seq == 0 {
+		logger.Logger.Warn("websocket user msg queue is full", zap.Int("user_id", m.UID), zap.String("msg_id", m.ID), zap.String("cacheKey", m.queueKey()))
+		return errs.ErrMsgQueueFull
+	}
+	m.Seq = seq
+	if len(values) > 1 {
+		dropped, _ := redis.Strings(values[1:], nil)
+		go dropQueueOverflow(m.UID, dropped)
+	}
+	return nil
+}
+
+// 消息写入用户的消息队列并通知各实例分发，replay为true时同时删除该消息的死信
+func (m *Msg) enqueue(replay bool) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	err = m.enqueueResult(enqueueWsMsgScript.Do(rd, m.enqueueArgs(replay)...))
+	// 重推的死信消息写入失败时仍保留在死信队列，不记录丢弃状态
+	if err == errs.ErrMsgQueueFull && !replay {
+		go m.UpdateMsgStatus(MsgStatusDropped, "", "queue full")
+	}
+	if err != nil {
+		logger.Logger.Warn("push websocket user msg to queue failed", zap.Any("msg", m), zap.String("cacheKey", m.queueKey()), zap.Error(err))
+		return
+	}
+
+	logger.Logger.Info("push websocket user msg to queue success", zap.Any("msg", m), zap.String("cacheKey", m.queueKey()))
+	return
+}
+
+// 批量写入消息队列，使用pipeline减少网络往返，返回每条消息的写入结果
+func PushWsMsgsToQueue(msgs []*Msg) (errList []error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	errList = make([]error, len(msgs))
+	if err := enqueueWsMsgScript.Load(rd); err != nil {
+		logger.Logger.Warn("load websocket push msg script failed", zap.Error(err))
+		for i := range errList {
+			errList[i] = err
+		}
+		return
+	}
+
+	for _, m := range msgs {
+		_ = enqueueWsMsgScript.SendHash(rd, m.enqueueArgs(false)...)
+	}
+	if err := rd.Flush(); err != nil {
+		logger.Logger.Warn("flush websocket push msg pipeline failed", zap.Error(err))
+		for i := range errList {
+			errList[i] = err
+		}
+		return
+	}
+	for i, m := range msgs {
+		if errList[i] = m.enqueueResult(rd.Receive()); errList[i] == errs.ErrMsgQueueFull {
+			go m.UpdateMsgStatus(MsgStatusDropped, "", "queue full")
+		}
+	}
+	return
+}
+
+// 获取序号范围内的消息记录，to为0时不限制
+func GetWsMsgLog(userId int, from, to int64) (msgs []Msg, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	max := "+inf"
+	if to > 0 {
+		max = strconv.FormatInt(to, 10)
+	}
+	cacheKey := msgLogPreCacheKey + strconv.Itoa(userId)
+	var messages []string
+	messages, err = redis.Strings(rd.Do("zRangeByScore", cacheKey, from, max, "LIMIT", 0, config.Settings.Websocket.MsgLogSize))
+	if err != nil {
+		logger.Logger.Warn("get websocket user msg log failed", zap.String("cacheKey", cacheKey), zap.Int64("from", from), zap.Int64("to", to), zap.Error(err))
+		return
+	}
+
+	for _, message := range messages {
+		var msg Msg
+		if err := json.Unmarshal([]byte(message), &msg); err != nil {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+// 按序号补齐客户端缺失的消息，只推送满足链接筛选条件的消息
+func (w *WsUserConnInfo) SyncMsg(from, to int64) {
+	msgs, err := GetWsMsgLog(w.UID, from, to)
+	if err != nil {
+		return
+	}
+
+	for _, msg := range msgs {
+		if !msg.MatchConn(w) || msg.IsExpired() {
+			continue
+		}
+		// 客户端主动补齐的消息不再重试
+		msg.Retries = 0
+		if err := msg.PushMsg(w.ID); err != nil {
+			return
+		}
+	}
+
+	logger.Logger.Info("sync websocket user msg success", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.Int64("from", from), zap.Int64("to", to), zap.Int("count", len(msgs)))
+}
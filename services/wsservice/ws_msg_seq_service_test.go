@@ -0,0 +1,82 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"go-ws/config"
+	"testing"
+)
+
+// 入队脚本的参数：6个固定key，每个通道一个key，10个参数
+func TestEnqueueArgs(t *testing.T) {
+	prev := config.Settings
+	t.Cleanup(func() { config.Settings = prev })
+	config.Settings = &config.Config{}
+	config.Settings.Websocket.InboxBackend = InboxBackendList
+	config.Settings.Websocket.QueueMaxSize = 100
+	config.Settings.Websocket.QueueFullPolicy = QueueFullDropOldest
+
+	keys := 6 + msgPriorityLanes
+	tests := []struct {
+		msg       Msg
+		lane      int
+		assignSeq string
+		replay    bool
+	}{
+		{Msg{ID: "1", UID: 7, Priority: MsgPriorityHigh}, msgLaneHigh, "1", false},
+		{Msg{ID: "2", UID: 7, Seq: 5}, msgLaneNormal, "0", false},
+		{Msg{ID: "3", UID: 7, Seq: 6, Priority: MsgPriorityLow}, msgLaneLow, "0", true},
+	}
+	for _, tt := range tests {
+		args := tt.msg.enqueueArgs(tt.replay)
+		if len(args) != keys+10 {
+			t.Fatalf("msg %s args len = %d, want %d", tt.msg.ID, len(args), keys+10)
+		}
+		for lane := 0; lane < msgPriorityLanes; lane++ {
+			if want := laneQueueKey(msgQueuePreCacheKey, 7, lane); args[6+lane] != want {
+				t.Errorf("msg %s lane key %d = %v, want %s", tt.msg.ID, lane, args[6+lane], want)
+			}
+		}
+
+		// 脚本用cjson解码消息后设置序号，消息必须是完整的json
+		var msg Msg
+		if err := json.Unmarshal([]byte(args[keys].(string)), &msg); err != nil || msg.ID != tt.msg.ID || msg.Seq != tt.msg.Seq {
+			t.Errorf("msg %s json = %v, err %v", tt.msg.ID, args[keys], err)
+		}
+		if args[keys+7] != tt.lane {
+			t.Errorf("msg %s lane = %v, want %d", tt.msg.ID, args[keys+7], tt.lane)
+		}
+		if args[keys+8] != tt.assignSeq {
+			t.Errorf("msg %s assign seq = %v, want %s", tt.msg.ID, args[keys+8], tt.assignSeq)
+		}
+		if replay := args[keys+9] == "1"; replay != tt.replay {
+			t.Errorf("msg %s replay = %v, want %v", tt.msg.ID, args[keys+9], tt.replay)
+		}
+	}
+}
+
+// 使用stream存储时队列上限不超过inbox_stream_max_len
+func TestQueueMaxSize(t *testing.T) {
+	prev := config.Settings
+	t.Cleanup(func() { config.Settings = prev })
+	config.Settings = &config.Config{}
+	config.Settings.Websocket.InboxStreamMaxLen = 50
+
+	tests := []struct {
+		backend      string
+		queueMaxSize int
+		want         int
+	}{
+		{InboxBackendList, 0, 0},
+		{InboxBackendList, 100, 100},
+		{InboxBackendStream, 0, 50},
+		{InboxBackendStream, 100, 50},
+		{InboxBackendStream, 20, 20},
+	}
+	for _, tt := range tests {
+		config.Settings.Websocket.InboxBackend = tt.backend
+		config.Settings.Websocket.QueueMaxSize = tt.queueMaxSize
+		if got := queueMaxSize(); got != tt.want {
+			t.Errorf("%s queue_max_size %d: queueMaxSize = %d, want %d", tt.backend, tt.queueMaxSize, got, tt.want)
+		}
+	}
+}
@@ -2,13 +2,17 @@ package wsservice
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
 	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
 	"go-ws/utils/http"
 	"go-ws/utils/logger"
 	"go.uber.org/zap"
 	"net/url"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,15 +20,32 @@ import (
 type Msg struct {
 	ID string `json:"id"`
 	UID int `json:"uid"`
+	Seq int64 `json:"seq,omitempty"` // 用户内单调递增的消息序号，客户端据此排序和发现缺失的消息
+	Type string `json:"type,omitempty"` // 消息类型，为空时为普通消息
+	Priority int `json:"priority,omitempty"` // 优先级，1为高，-1为低，默认为普通
+	From int `json:"from,omitempty"` // 发送者的用户ID，已读回执推送给发送者
+	ExpiresAt int64 `json:"expires_at,omitempty"` // 过期时间，过期后不再推送和重试
+	CollapseKey string `json:"collapse_key,omitempty"` // 合并key，未推送的旧消息被相同key的新消息替换
 	Content interface{} `json:"content"`
 	Retries int `json:"retries"`
 	ConnId  string `json:"conn_id"`
+	ConnSeq int64 `json:"conn_seq,omitempty"` // 链接内的推送序号，断线重连时客户端上报最后收到的序号
+	Include *ConnFilter `json:"include,omitempty"` // 只推送给满足条件的链接
+	Exclude *ConnFilter `json:"exclude,omitempty"` // 不推送给满足条件的链接
+	OriginConnId string `json:"origin_conn_id,omitempty"` // 发起操作的链接，不推送回该链接
+	StreamId string `json:"stream_id,omitempty"` // 使用stream存储时的消息ID，推送完成后确认
+	Attempt int `json:"attempt,omitempty"` // 已重试的次数
+	Backoff *BackoffPolicy `json:"backoff,omitempty"` // 重试策略，为空时使用默认策略
 }
 
 // 接收消息
 type RecMsg struct {
 	ID string `json:"id"` // 与Msg里的ID一致
 	Content interface{} `json:"content"`
+	Type string `json:"type,omitempty"` // 消息类型，为空时表示已收到的ACK
+	Seq int64 `json:"seq,omitempty"` // 累计确认，序号不大于seq的消息都已收到或已读
+	From int64 `json:"from,omitempty"` // 补齐消息的起始序号
+	To int64 `json:"to,omitempty"` // 补齐消息的结束序号，为0时补齐到最新
 }
 
 const (
@@ -32,46 +53,45 @@ const (
 	msgQueuePreCacheKey = "ws_user_msg_queue:"
 	// 消息事件推送失败的延迟队列
 	msgDelayQueuePreCacheKey = "ws_user_msg_delay_queue:"
+	// 延迟队列中发给某个链接的消息，断线重连时据此立即重推，不用遍历用户的延迟队列
+	msgDelayConnPreCacheKey = "ws_user_msg_delay_conn:"
 	// 消息收到ack后的消息ID
 	msgAckPreCacheKey = "ws_user_msg_send_ack_list:"
-	// 消息延迟重新推送间隔时间(s)
-	msgDelayTimeOut = 3
 )
 
-// 消息事件写入队列
-func (m *Msg) PushWsMsgToQueue() (err error) {
-	rd := myredis.NewRedis("default_redis").Get()
-
-	var data []byte
-	data, _ = json.Marshal(m)
-
-	cacheKey := msgQueuePreCacheKey + strconv.Itoa(m.UID)
-	_, err = rd.Do("lPush", cacheKey, string(data))
-	if err != nil {
-		logger.Logger.Warn("lPush websocket user msg to queue failed", zap.Any("msg", m), zap.String("cacheKey", cacheKey), zap.Error(err))
-		return
-	}
-
-	logger.Logger.Info("lPush websocket user msg to queue success", zap.Any("msg", m), zap.String("cacheKey", cacheKey))
+// 生成消息ID
+func NewMsgId() string {
+	return fmt.Sprintf("%d-%s", time.Now().Unix(), uuid.New().String())
+}
 
-	return
+// 消息事件写入队列，新消息分配序号，重新入队的消息保留原序号
+func (m *Msg) PushWsMsgToQueue() (err error) {
+	return m.enqueue(false)
 }
 
-// 获取消息事件内容
-func PopWsMsgFromQueue(userId int) (msg Msg, err error) {
+// 获取消息事件内容，按lanes的顺序取第一个非空通道的消息
+func PopWsMsgFromQueue(userId int, lanes []int) (msg Msg, err error) {
 	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
 
+	args := redis.Args{}
+	for _, lane := range lanes {
+		args = args.Add(laneQueueKey(msgQueuePreCacheKey, userId, lane))
+	}
+	args = args.Add(msgQueueDepthKey, userId)
 	var data []byte
-	cacheKey := msgQueuePreCacheKey + strconv.Itoa(userId)
-	data, err = redis.Bytes(rd.Do("lPop", cacheKey))
+	data, err = redis.Bytes(popWsMsgByPriorityScript.Do(rd, args...))
 	if err != nil {
-		logger.Logger.Warn("lPop websocket user msg from queue failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+		if err == redis.ErrNil {
+			return
+		}
+		logger.Logger.Warn("lPop websocket user msg from queue failed", zap.Int("user_id", userId), zap.Ints("lanes", lanes), zap.Error(err))
 		return
 	}
 
 	err = json.Unmarshal(data, &msg)
 	if err != nil {
-		logger.Logger.Warn("lPop websocket user msg from queue json unmarshal failed", zap.String("cacheKey", cacheKey), zap.Int("user_id", userId), zap.ByteString("data", data), zap.Error(err))
+		logger.Logger.Warn("lPop websocket user msg from queue json unmarshal failed", zap.Int("user_id", userId), zap.ByteString("data", data), zap.Error(err))
 		return
 	}
 	return
@@ -80,54 +100,39 @@ func PopWsMsgFromQueue(userId int) (msg Msg, err error) {
 // 消息事件推送失败的延迟队列，增加排队时间
 func (m *Msg) PushWsMsgToDelayQueue() (err error) {
 	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
 
 	var data []byte
 	data, _ = json.Marshal(m)
 
+	// 同时更新延迟队列索引中该用户最早的到期时间，并记录到链接的消息列表，有效期与重连token一致
+	luaScript := `
+	redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+	local score = redis.call('ZSCORE', KEYS[2], ARGV[3])
+	if not score or tonumber(score) > tonumber(ARGV[1]) then
+		redis.call('ZADD', KEYS[2], ARGV[1], ARGV[3])
+	end
+	redis.call('SADD', KEYS[3], ARGV[2])
+	redis.call('EXPIRE', KEYS[3], ARGV[4])
+	return 1
+	`
+
+	script := redis.NewScript(3, luaScript)
 	cacheKey := msgDelayQueuePreCacheKey + strconv.Itoa(m.UID)
-	_, err = rd.Do("zAdd", cacheKey, time.Now().Unix() + msgDelayTimeOut, string(data))
+	_, err = script.Do(rd, cacheKey, msgDelayIndexKey, msgDelayConnPreCacheKey+m.ConnId, m.nextRetryTime(), string(data), m.UID, wsUserResumeTokenTTL)
 	if err != nil {
 		logger.Logger.Warn(" websocket msg to delay queue failed", zap.Any("msg", m), zap.Error(err))
 		return
 	}
+	wakeupDelayLoop()
 
 	logger.Logger.Info("zAdd websocket msg to delay queue success", zap.Any("msg", m))
 	return
 }
 
-// 从推送失败的延时队列读取消息
-func PopWsMsgFromDelayQueue(userId int) (msg Msg, err error) {
-	rd := myredis.NewRedis("default_redis").Get()
-
-	// 执行lua脚本，实现事务，使查删两个操作具有原子性
-	luaScript := `
-	local message = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'WITHSCORES', 'LIMIT', 0, 1)
-	if #message > 0 then
-		redis.Call('ZREM', KEYS[1], message[1]);
-		return message[1];
-	else
-		return nil;
-	end
-	`
-
-	script := redis.NewScript(1, luaScript)
-	var cacheKey = msgDelayQueuePreCacheKey + strconv.Itoa(userId)
-
-	var data []byte
-	data, err = redis.Bytes(script.Do(rd, cacheKey, time.Now().Unix()))
-	if err != nil {
-		logger.Logger.Debug("zrangebyscore websocket msg from delay queue failed", zap.String("cacheKey", cacheKey), zap.Error(err))
-		return
-	}
-
-	err = json.Unmarshal(data, &msg)
-	if err != nil {
-		logger.Logger.Warn("zrangebyscore websocket msg from delay queue json unmarshal failed", zap.String("cacheKey", cacheKey), zap.ByteString("data", data), zap.Error(err))
-		return
-	}
-
-	logger.Logger.Debug("get websocket msg from delay queue success", zap.String("cacheKey", cacheKey), zap.Any("msg", msg))
-	return
+// 消息序号不大于链接确认的序号时视为已收到
+func (m Msg) isAckedBySeq(w *WsUserConnInfo) bool {
+	return (m.ConnSeq > 0 && m.ConnSeq <= w.AckSeq) || (m.Seq > 0 && m.Seq <= atomic.LoadInt64(&w.DeliveredSeq))
 }
 
 // 消息收到ACK后保存
@@ -169,27 +174,46 @@ func GetMsgAck(userId int, msgId, userConnId string) (ack int, err error) {
 	return
 }
 
-// 消息推送本机的用户链接
+// 消息推送本机的用户链接，按链接协商的编码序列化
 func (m Msg) PushMsg(userConnId string) (err error) {
-	msg, err := json.Marshal(m)
+	w, ok := GetLocalUserConn(userConnId)
+	if !ok {
+		return errs.ErrWebSocketConnectionClosed
+	}
+	if m.IsExpired() {
+		return errs.ErrMsgExpired
+	}
+
+	m.ConnId = userConnId
+	m.ConnSeq = atomic.AddInt64(&w.Seq, 1)
+	// 筛选条件只在服务端使用，不推送给客户端
+	m.Include, m.Exclude, m.OriginConnId = nil, nil, ""
+	// stream消息ID只在服务端使用
+	out := m
+	out.StreamId = ""
+	msg, err := w.wsConnection.Codec.Marshal(out)
 	if err != nil {
-		logger.Logger.Warn("websocket msg json marshal failed", zap.Any("msg", m), zap.Error(err))
+		logger.Logger.Warn("websocket msg encode failed", zap.Any("msg", m), zap.String("codec", w.Codec), zap.Error(err))
 		return
 	}
 
-	if w, ok := AllWsUserConnInfos[userConnId]; ok {
-		if err = w.wsConnection.Send(msg); err != nil {
-			logger.Logger.Warn("push websocket msg to user failed", zap.String("user_conn_id", userConnId), zap.Any("msg", m), zap.Error(err))
-			return
-		}
+	// 写入链接的发送缓冲区，由写协程推送
+	if err = w.Enqueue(msg, &m); err != nil {
+		logger.Logger.Warn("push websocket msg to user failed", zap.String("user_conn_id", userConnId), zap.Any("msg", m), zap.Error(err))
+		return
+	}
+
+	// 记录消息到延迟队列，判断用户是否收到消息ACK，最后一次重试也要检查，未收到ACK时进入死信队列
+	if m.Retries > 0 || m.Attempt > 0 {
+		go m.PushWsMsgToDelayQueue()
 	}
 
-	logger.Logger.Info("push websocket msg success", zap.Int("user_id", m.UID), zap.Any("msg", msg), zap.String("user_conn_id", m.ConnId))
+	logger.Logger.Info("push websocket msg success", zap.Int("user_id", m.UID), zap.Any("msg", m), zap.String("user_conn_id", userConnId))
 
 	return
 }
 
-// 推送消息到用户登录的其他服务器
+// 推送消息到用户登录的其他服务器，服务间统一使用json传输，由目标服务器按链接的编码推送
 func (m Msg) PushMsgToOtherServer(node, userConnId string) (err error) {
 	msg, err := json.Marshal(m)
 	if err != nil {
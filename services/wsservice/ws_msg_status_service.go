@@ -0,0 +1,254 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
+	"go-ws/utils/http"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 消息的推送状态
+const (
+	// 已写入用户的消息队列
+	MsgStatusQueued = "queued"
+	// 已分发到用户的链接
+	MsgStatusDispatched = "dispatched"
+	// 已写入某个链接
+	MsgStatusDelivered = "delivered"
+	// 客户端已确认收到
+	MsgStatusAcked = "acked"
+	// 客户端已读
+	MsgStatusRead = "read"
+	// 客户端已忽略
+	MsgStatusDismissed = "dismissed"
+	// 消息已过期
+	MsgStatusExpired = "expired"
+	// 重试失败进入死信队列
+	MsgStatusDeadLettered = "dead_lettered"
+	// 队列已满被删除
+	MsgStatusDropped = "dropped"
+	// 已撤回
+	MsgStatusRecalled = "recalled"
+	// 已编辑，不改变当前状态，只记录变更
+	MsgStatusEdited = "edited"
+)
+
+// 状态的先后顺序，状态只能前进，过期、死信、丢弃和撤回为最终状态
+var msgStatusRank = map[string]int{
+	MsgStatusQueued:       1,
+	MsgStatusDispatched:   2,
+	MsgStatusDelivered:    3,
+	MsgStatusAcked:        4,
+	MsgStatusRead:         5,
+	MsgStatusDismissed:    5,
+	MsgStatusExpired:      6,
+	MsgStatusDeadLettered: 6,
+	MsgStatusDropped:      6,
+	MsgStatusRecalled:     6,
+}
+
+const (
+	// 消息当前状态
+	msgStatusPreCacheKey = "ws_msg_status:"
+	// 消息状态变更记录
+	msgStatusHistoryPreCacheKey = "ws_msg_status_history:"
+)
+
+// 消息状态
+type MsgStatus struct {
+	ID          string           `json:"id"`
+	UID         int              `json:"uid"`
+	From        int              `json:"from,omitempty"`
+	State       string           `json:"state"`
+	UpdatedAt   int64            `json:"updated_at"`
+	CallbackUrl string           `json:"callback_url,omitempty"`
+	History     []MsgStatusEvent `json:"history"`
+}
+
+// 消息状态变更
+type MsgStatusEvent struct {
+	State  string `json:"state"`
+	ConnId string `json:"conn_id,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Time   int64  `json:"time"`
+}
+
+// 开始记录消息状态，callbackUrl不为空时状态变更后回调通知
+func (m Msg) InitMsgStatus(callbackUrl string) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	event := MsgStatusEvent{State: MsgStatusQueued, Time: time.Now().Unix()}
+	var data []byte
+	data, _ = json.Marshal(event)
+
+	ttl := config.Settings.Websocket.MsgStatusTTL
+	cacheKey := msgStatusPreCacheKey + m.ID
+	historyKey := msgStatusHistoryPreCacheKey + m.ID
+	rd.Send("MULTI")
+	rd.Send("hMSet", cacheKey, "id", m.ID, "uid", m.UID, "from", m.From, "state", event.State, "rank", msgStatusRank[event.State], "updated_at", event.Time, "callback_url", callbackUrl)
+	rd.Send("expire", cacheKey, ttl)
+	rd.Send("rPush", historyKey, string(data))
+	rd.Send("expire", historyKey, ttl)
+	_, err = rd.Do("EXEC")
+	if err != nil {
+		logger.Logger.Warn("init websocket msg status failed", zap.String("msg_id", m.ID), zap.Error(err))
+		return
+	}
+
+	if callbackUrl != "" {
+		go notifyMsgStatus(callbackUrl, m.ID, m.UID, event)
+	}
+	return
+}
+
+// 记录消息状态变更，未记录状态或不属于该用户的消息忽略
+func (m Msg) UpdateMsgStatus(state, connId, reason string) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	event := MsgStatusEvent{State: state, ConnId: connId, Reason: reason, Time: time.Now().Unix()}
+	var data []byte
+	data, _ = json.Marshal(event)
+
+	// 状态只能前进，变更记录全部保留，返回回调地址；客户端可以上报任意消息ID，只更新属于该用户的消息
+	luaScript := `
+	if redis.call('HGET', KEYS[1], 'uid') ~= ARGV[6] then
+		return false
+	end
+	local rank = tonumber(redis.call('HGET', KEYS[1], 'rank') or '0')
+	if tonumber(ARGV[2]) >= rank then
+		redis.call('HMSET', KEYS[1], 'state', ARGV[1], 'rank', ARGV[2], 'updated_at', ARGV[3])
+	end
+	redis.call('RPUSH', KEYS[2], ARGV[4])
+	redis.call('EXPIRE', KEYS[2], ARGV[5])
+	return redis.call('HGET', KEYS[1], 'callback_url')
+	`
+
+	script := redis.NewScript(2, luaScript)
+	var callbackUrl string
+	callbackUrl, err = redis.String(script.Do(rd, msgStatusPreCacheKey+m.ID, msgStatusHistoryPreCacheKey+m.ID,
+		state, msgStatusRank[state], event.Time, string(data), config.Settings.Websocket.MsgStatusTTL, m.UID))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		logger.Logger.Warn("update websocket msg status failed", zap.String("msg_id", m.ID), zap.String("state", state), zap.Error(err))
+		return
+	}
+
+	if callbackUrl != "" {
+		go notifyMsgStatus(callbackUrl, m.ID, m.UID, event)
+	}
+	return
+}
+
+// 重推死信消息前将状态从死信恢复为已入队，其他状态不变，返回是否已恢复
+func (m Msg) resetDeadLetterStatus() (reset bool, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	event := MsgStatusEvent{State: MsgStatusQueued, Reason: "replay", Time: time.Now().Unix()}
+	var data []byte
+	data, _ = json.Marshal(event)
+
+	luaScript := `
+	if redis.call('HGET', KEYS[1], 'state') ~= ARGV[1] then
+		return 0
+	end
+	redis.call('HMSET', KEYS[1], 'state', ARGV[2], 'rank', ARGV[3], 'updated_at', ARGV[4])
+	redis.call('RPUSH', KEYS[2], ARGV[5])
+	redis.call('EXPIRE', KEYS[2], ARGV[6])
+	return 1
+	`
+
+	script := redis.NewScript(2, luaScript)
+	reset, err = redis.Bool(script.Do(rd, msgStatusPreCacheKey+m.ID, msgStatusHistoryPreCacheKey+m.ID,
+		MsgStatusDeadLettered, event.State, msgStatusRank[event.State], event.Time, string(data), config.Settings.Websocket.MsgStatusTTL))
+	if err != nil {
+		logger.Logger.Warn("reset websocket msg dead letter status failed", zap.String("msg_id", m.ID), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 检查回调地址，只允许http(s)和配置的域名，为空时不检查
+func CheckCallbackUrl(callbackUrl string) error {
+	if callbackUrl == "" {
+		return nil
+	}
+	u, err := url.Parse(callbackUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errs.ErrCallbackUrlInvalid
+	}
+	for _, host := range config.Settings.Websocket.CallbackHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return nil
+		}
+	}
+	return errs.ErrCallbackUrlInvalid
+}
+
+// 回调通知消息状态变更
+func notifyMsgStatus(callbackUrl, msgId string, userId int, event MsgStatusEvent) {
+	var data = url.Values{}
+	data.Add("id", msgId)
+	data.Add("uid", strconv.Itoa(userId))
+	data.Add("state", event.State)
+	data.Add("conn_id", event.ConnId)
+	data.Add("reason", event.Reason)
+	data.Add("time", strconv.FormatInt(event.Time, 10))
+	_ = http.Notify(callbackUrl, data)
+}
+
+// 查询消息状态及变更记录
+func GetMsgStatus(msgId string) (status MsgStatus, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	var fields map[string]string
+	fields, err = redis.StringMap(rd.Do("hGetAll", msgStatusPreCacheKey+msgId))
+	if err != nil {
+		logger.Logger.Warn("get websocket msg status failed", zap.String("msg_id", msgId), zap.Error(err))
+		return
+	}
+	if len(fields) == 0 {
+		err = errs.ErrMsgStatusNotFound
+		return
+	}
+
+	status.ID = fields["id"]
+	status.UID, _ = strconv.Atoi(fields["uid"])
+	status.From, _ = strconv.Atoi(fields["from"])
+	status.State = fields["state"]
+	status.UpdatedAt, _ = strconv.ParseInt(fields["updated_at"], 10, 64)
+	status.CallbackUrl = fields["callback_url"]
+
+	var history []string
+	history, err = redis.Strings(rd.Do("lRange", msgStatusHistoryPreCacheKey+msgId, 0, -1))
+	if err != nil {
+		logger.Logger.Warn("get websocket msg status history failed", zap.String("msg_id", msgId), zap.Error(err))
+		return
+	}
+	status.History = make([]MsgStatusEvent, 0, len(history))
+	for _, data := range history {
+		var event MsgStatusEvent
+		if json.Unmarshal([]byte(data), &event) == nil {
+			status.History = append(status.History, event)
+		}
+	}
+	// 变更记录可能并发写入，按时间排序
+	sort.SliceStable(status.History, func(i, j int) bool {
+		return status.History[i].Time < status.History[j].Time
+	})
+	return
+}
@@ -0,0 +1,213 @@
+package wsservice
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 所有服务实例，值为实例所在的服务器地址
+	wsNodeInstanceListKey = "ws_node_instance_list"
+	// 服务实例存活标记，定时续期，过期表示实例已宕机
+	wsNodeInstanceAlivePreCacheKey = "ws_node_instance_alive:"
+	// 服务实例上的链接ID列表
+	wsNodeInstanceConnListPreCacheKey = "ws_node_instance_conn_list:"
+	// 回收宕机实例链接的锁，防止多个实例同时回收
+	wsNodeInstanceSweepLockPreCacheKey = "ws_node_instance_sweep_lock:"
+)
+
+var (
+	localNode     string
+	localNodeOnce sync.Once
+	// 本进程的实例ID，平滑重启时新旧进程的服务器地址相同，用实例ID区分
+	localInstance = uuid.New().String()
+)
+
+// 本机的服务器地址，用于服务间推送消息
+func LocalNode() string {
+	localNodeOnce.Do(func() {
+		ip, _ := utils.GetLocalIP()
+		port := strings.Split(config.Settings.App.Bind, ":")[1]
+		localNode = ip + ":" + port
+	})
+	return localNode
+}
+
+// 本进程的实例ID
+func LocalInstance() string {
+	return localInstance
+}
+
+// 注册本实例，定时续期存活标记并回收宕机实例的链接
+func StartNodeInstance() {
+	if err := refreshNodeInstance(); err != nil {
+		logger.Logger.Warn("register websocket node instance failed", zap.String("node", LocalNode()), zap.String("instance", localInstance), zap.Error(err))
+	}
+	// 启动时立即回收，本机上次异常退出留下的链接不用等到下次检查
+	SweepDeadNodeInstances()
+
+	go func() {
+		heartbeat := time.NewTicker(time.Duration(config.Settings.Websocket.NodeHeartbeat) * time.Second)
+		sweep := time.NewTicker(time.Duration(config.Settings.Websocket.NodeSweepInterval) * time.Second)
+		defer heartbeat.Stop()
+		defer sweep.Stop()
+		for {
+			select {
+			case <-heartbeat.C:
+				if err := refreshNodeInstance(); err != nil {
+					logger.Logger.Warn("refresh websocket node instance failed", zap.String("instance", localInstance), zap.Error(err))
+				}
+			case <-sweep.C:
+				SweepDeadNodeInstances()
+			}
+		}
+	}()
+}
+
+// 续期本实例的存活标记
+func refreshNodeInstance() (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	rd.Send("MULTI")
+	rd.Send("hSet", wsNodeInstanceListKey, localInstance, LocalNode())
+	rd.Send("set", wsNodeInstanceAlivePreCacheKey+localInstance, LocalNode(), "EX", config.Settings.Websocket.NodeTTL)
+	_, err = rd.Do("EXEC")
+	return
+}
+
+// 添加本实例的链接ID
+func AddNodeInstanceConnId(userConnId string) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	_, err = rd.Do("sAdd", wsNodeInstanceConnListPreCacheKey+localInstance, userConnId)
+	if err != nil {
+		logger.Logger.Warn("add node instance conn id failed", zap.String("instance", localInstance), zap.String("user_conn_id", userConnId), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 删除本实例的链接ID
+func DelNodeInstanceConnId(userConnId string) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	_, err = rd.Do("sRem", wsNodeInstanceConnListPreCacheKey+localInstance, userConnId)
+	if err != nil {
+		logger.Logger.Warn("del node instance conn id failed", zap.String("instance", localInstance), zap.String("user_conn_id", userConnId), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 获取某个实例的链接ID列表
+func GetNodeInstanceConnIdList(instance string) (userConnIdList []string, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	userConnIdList, err = redis.Strings(rd.Do("sMembers", wsNodeInstanceConnListPreCacheKey+instance))
+	if err != nil {
+		logger.Logger.Warn("get node instance conn id list failed", zap.String("instance", instance), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 获取存活标记已过期的实例
+func getDeadNodeInstances() (instances map[string]string, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	var all map[string]string
+	all, err = redis.StringMap(rd.Do("hGetAll", wsNodeInstanceListKey))
+	if err != nil {
+		logger.Logger.Warn("get node instance list failed", zap.Error(err))
+		return
+	}
+
+	instances = make(map[string]string)
+	for instance, node := range all {
+		var alive bool
+		alive, err = redis.Bool(rd.Do("exists", wsNodeInstanceAlivePreCacheKey+instance))
+		if err != nil {
+			logger.Logger.Warn("check node instance alive failed", zap.String("instance", instance), zap.Error(err))
+			return
+		}
+		if !alive {
+			instances[instance] = node
+		}
+	}
+	return
+}
+
+// 回收宕机实例的链接，只处理存活标记已过期的实例，不影响其他正常服务器的链接
+func SweepDeadNodeInstances() {
+	instances, err := getDeadNodeInstances()
+	if err != nil {
+		return
+	}
+
+	for instance, node := range instances {
+		lockKey := wsNodeInstanceSweepLockPreCacheKey + instance
+		token, ok := acquireLock(lockKey, 60)
+		if !ok {
+			continue
+		}
+
+		count, err := closeNodeInstanceConn(instance)
+		if useStreamInbox() {
+			// 接管宕机实例未确认的stream消息
+			claimed, err := claimNodeInstanceStreamMsg(instance)
+			logger.Logger.Info("claim dead websocket node instance stream msg", zap.String("instance", instance), zap.Int("count", claimed), zap.Error(err))
+		}
+		if err == nil {
+			rd := myredis.NewRedis("default_redis").Get()
+			_, err = rd.Do("hDel", wsNodeInstanceListKey, instance)
+			rd.Close()
+		}
+		logger.Logger.Info("sweep dead websocket node instance", zap.String("node", node), zap.String("instance", instance), zap.Int("count", count), zap.Error(err))
+
+		releaseLock(lockKey, token)
+	}
+}
+
+// 将某个实例在redis中的链接标记为关闭，链接已被断线重连接管到其他实例时跳过
+func closeNodeInstanceConn(instance string) (count int, err error) {
+	var userConnIdList []string
+	userConnIdList, err = GetNodeInstanceConnIdList(instance)
+	if err != nil {
+		return
+	}
+
+	for _, userConnId := range userConnIdList {
+		w, err := GetWsUserConnInfo(userConnId)
+		if err != nil || w.Closed || w.Instance != instance {
+			continue
+		}
+
+		w.Closed = true
+		w.DisConnectTime = time.Now().Unix()
+		if takenOver, err := w.UpdateClosedUserInfo(); err != nil || takenOver {
+			continue
+		}
+		// 宕机实例的链接同样可以在宽限时间内断线重连
+		w.expireResumeToken()
+		w.DelUserInfo()
+		count++
+	}
+
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+	_, err = rd.Do("del", wsNodeInstanceConnListPreCacheKey+instance)
+	return
+}
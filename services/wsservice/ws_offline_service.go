@@ -0,0 +1,112 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+const (
+	// 用户离线消息，按序号排序
+	msgOfflinePreCacheKey = "ws_user_msg_offline:"
+)
+
+// 用户没有可推送的链接时保存为离线消息，超出上限时删除最旧的消息
+func (m Msg) SaveOfflineMsg() (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	// 离线消息按用户序号排序，只在服务端使用的字段不保存
+	m.ConnId, m.ConnSeq, m.StreamId = "", 0, ""
+	var data []byte
+	data, _ = json.Marshal(m)
+
+	cacheKey := msgOfflinePreCacheKey + strconv.Itoa(m.UID)
+	rd.Send("MULTI")
+	rd.Send("zAdd", cacheKey, m.Seq, string(data))
+	rd.Send("zRemRangeByRank", cacheKey, 0, -config.Settings.Websocket.OfflineMaxSize-1)
+	rd.Send("expire", cacheKey, config.Settings.Websocket.OfflineTTL)
+	_, err = rd.Do("EXEC")
+	if err != nil {
+		logger.Logger.Warn("save websocket offline msg failed", zap.Any("msg", m), zap.String("cacheKey", cacheKey), zap.Error(err))
+		return
+	}
+
+	logger.Logger.Info("save websocket offline msg success", zap.Any("msg", m), zap.String("cacheKey", cacheKey))
+	return
+}
+
+// 分页获取序号大于fromSeq的离线消息
+func GetOfflineMsgList(userId int, fromSeq int64, limit int) (msgs []Msg, hasMore bool, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgOfflinePreCacheKey + strconv.Itoa(userId)
+	var messages []string
+	// 多取一条判断是否还有下一页
+	messages, err = redis.Strings(rd.Do("zRangeByScore", cacheKey, "("+strconv.FormatInt(fromSeq, 10), "+inf", "LIMIT", 0, limit+1))
+	if err != nil {
+		logger.Logger.Warn("get websocket offline msg list failed", zap.String("cacheKey", cacheKey), zap.Int64("from_seq", fromSeq), zap.Error(err))
+		return
+	}
+
+	if len(messages) > limit {
+		messages = messages[:limit]
+		hasMore = true
+	}
+	msgs = make([]Msg, 0, len(messages))
+	for _, message := range messages {
+		var msg Msg
+		if err := json.Unmarshal([]byte(message), &msg); err != nil || msg.staleReason() != "" {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+// 链接注册后按序号推送离线消息，推送后删除，不满足链接筛选条件的消息保留
+func (w *WsUserConnInfo) FlushOfflineMsg() {
+	// 和消息分发使用同一个锁，离线消息先于队列中的消息推送
+	lockKey := msgDispatchLockPreCacheKey + strconv.Itoa(w.UID)
+	token, ok := waitLock(lockKey, msgDispatchLockTTL, msgDispatchLockWait)
+	if !ok {
+		logger.Logger.Warn("flush websocket offline msg wait lock timeout", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID))
+		return
+	}
+	defer releaseLock(lockKey, token)
+
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgOfflinePreCacheKey + strconv.Itoa(w.UID)
+	messages, err := redis.Strings(rd.Do("zRange", cacheKey, 0, -1))
+	if err != nil {
+		logger.Logger.Warn("get websocket offline msg failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+		return
+	}
+
+	count := 0
+	for _, message := range messages {
+		var msg Msg
+		if json.Unmarshal([]byte(message), &msg) != nil || msg.dropStale() {
+			_, _ = rd.Do("zRem", cacheKey, message)
+			continue
+		}
+		if !msg.MatchConn(w) {
+			continue
+		}
+		if err = msg.PushMsg(w.ID); err != nil {
+			break
+		}
+		_, _ = rd.Do("zRem", cacheKey, message)
+		msg.releaseCollapseKey()
+		count++
+	}
+
+	logger.Logger.Info("flush websocket offline msg success", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.Int("count", count))
+}
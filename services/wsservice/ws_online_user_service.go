@@ -5,14 +5,13 @@ import (
 	myredis "go-ws/databases/redis"
 	"go-ws/utils/logger"
 	"go.uber.org/zap"
-	"strconv"
 )
 
 // 添加链接的用户ID
 func AddOnlineUserId(userId int) (err error) {
 	rd := myredis.NewRedis("default_redis").Get()
 
-	cacheKey := wsUserOnlineListKey + strconv.Itoa(userId)
+	cacheKey := wsUserOnlineListKey
 
 	// set集合不会有相同的值
 	_, err = rd.Do("sAdd", cacheKey, userId)
@@ -28,7 +27,7 @@ func AddOnlineUserId(userId int) (err error) {
 func DelOnlineUserId(userId int) (err error) {
 	rd := myredis.NewRedis("default_redis").Get()
 
-	cacheKey := wsUserOnlineListKey + strconv.Itoa(userId)
+	cacheKey := wsUserOnlineListKey
 
 	_, err = rd.Do("sRem", cacheKey, userId)
 	if err != nil {
@@ -0,0 +1,114 @@
+package wsservice
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	"strconv"
+)
+
+// 消息优先级，高优先级的消息先推送，可能先于序号更小的消息到达客户端
+const (
+	MsgPriorityLow    = -1
+	MsgPriorityNormal = 0
+	MsgPriorityHigh   = 1
+)
+
+// 用户队列和链接发送缓冲区按优先级分为多个通道，下标越小优先级越高
+const (
+	msgLaneHigh = iota
+	msgLaneNormal
+	msgLaneLow
+	msgPriorityLanes
+)
+
+// 各通道的队列key后缀，普通优先级沿用原有的队列
+var msgLaneSuffix = [msgPriorityLanes]string{":high", "", ":low"}
+
+// 消息所在的通道
+func (m Msg) lane() int {
+	switch {
+	case m.Priority > MsgPriorityNormal:
+		return msgLaneHigh
+	case m.Priority < MsgPriorityNormal:
+		return msgLaneLow
+	}
+	return msgLaneNormal
+}
+
+// 用户某个通道的队列key
+func laneQueueKey(preCacheKey string, userId, lane int) string {
+	return preCacheKey + strconv.Itoa(userId) + msgLaneSuffix[lane]
+}
+
+// 按优先级选择推送的通道，高优先级通道连续推送priority_burst条后让低优先级通道推送一条，避免低优先级消息饿死
+type priorityPicker struct {
+	burst  int
+	streak [msgPriorityLanes]int // 各通道在更低优先级通道推送后连续推送的条数
+}
+
+func newPriorityPicker() *priorityPicker {
+	return &priorityPicker{burst: config.Settings.Websocket.PriorityBurst}
+}
+
+// 通道的推送顺序，连续推送达到上限的通道排到最后，其中优先级低的在前
+func (p *priorityPicker) order() []int {
+	lanes := make([]int, 0, msgPriorityLanes)
+	var yielded []int
+	for lane := 0; lane < msgPriorityLanes; lane++ {
+		// 最低优先级的通道不需要让出
+		if lane < msgPriorityLanes-1 && p.streak[lane] >= p.burst {
+			yielded = append([]int{lane}, yielded...)
+			continue
+		}
+		lanes = append(lanes, lane)
+	}
+	return append(lanes, yielded...)
+}
+
+// 记录通道推送了一条消息，更高优先级的通道重新计数
+func (p *priorityPicker) served(lane int) {
+	p.streak[lane]++
+	for higher := 0; higher < lane; higher++ {
+		p.streak[higher] = 0
+	}
+}
+
+// 将多个通道读取到的消息按推送顺序排列
+func (p *priorityPicker) sort(msgs []Msg) []Msg {
+	var lanes [msgPriorityLanes][]Msg
+	for _, msg := range msgs {
+		lanes[msg.lane()] = append(lanes[msg.lane()], msg)
+	}
+
+	sorted := make([]Msg, 0, len(msgs))
+	for len(sorted) < len(msgs) {
+		for _, lane := range p.order() {
+			if len(lanes[lane]) > 0 {
+				sorted = append(sorted, lanes[lane][0])
+				lanes[lane] = lanes[lane][1:]
+				p.served(lane)
+				break
+			}
+		}
+	}
+	return sorted
+}
+
+// 按通道顺序取出第一个非空通道的消息，最后一个key为队列长度统计，同时更新用户的队列长度
+var popWsMsgByPriorityScript = redis.NewScript(msgPriorityLanes+1, `
+	local depthKey = KEYS[#KEYS]
+	local message = false
+	local total = 0
+	for i = 1, #KEYS - 1 do
+		if not message then
+			message = redis.call('LPOP', KEYS[i])
+		end
+		total = total + redis.call('LLEN', KEYS[i])
+	end
+	if total > 0 then
+		redis.call('ZADD', depthKey, total, ARGV[1])
+	else
+		redis.call('ZREM', depthKey, ARGV[1])
+	end
+	return message
+	`)
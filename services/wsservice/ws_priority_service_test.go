@@ -0,0 +1,80 @@
+package wsservice
+
+import (
+	"reflect"
+	"testing"
+)
+
+func msgIds(msgs []Msg) []string {
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func TestMsgLane(t *testing.T) {
+	tests := []struct {
+		priority int
+		want     int
+	}{
+		{MsgPriorityHigh, msgLaneHigh},
+		{5, msgLaneHigh},
+		{MsgPriorityNormal, msgLaneNormal},
+		{MsgPriorityLow, msgLaneLow},
+		{-5, msgLaneLow},
+	}
+	for _, tt := range tests {
+		if got := (Msg{Priority: tt.priority}).lane(); got != tt.want {
+			t.Errorf("priority %d lane = %d, want %d", tt.priority, got, tt.want)
+		}
+	}
+}
+
+// 连续推送达到上限的通道排到最后，其中优先级低的在前
+func TestPriorityPickerOrder(t *testing.T) {
+	p := &priorityPicker{burst: 2}
+	if got := p.order(); !reflect.DeepEqual(got, []int{msgLaneHigh, msgLaneNormal, msgLaneLow}) {
+		t.Fatalf("order = %v", got)
+	}
+
+	p.served(msgLaneHigh)
+	p.served(msgLaneHigh)
+	if got := p.order(); !reflect.DeepEqual(got, []int{msgLaneNormal, msgLaneLow, msgLaneHigh}) {
+		t.Fatalf("order after high burst = %v", got)
+	}
+
+	p.served(msgLaneNormal)
+	p.served(msgLaneNormal)
+	if got := p.order(); !reflect.DeepEqual(got, []int{msgLaneHigh, msgLaneLow, msgLaneNormal}) {
+		t.Fatalf("order after normal burst = %v", got)
+	}
+
+	// 最低优先级的通道推送后所有通道重新计数
+	p.served(msgLaneLow)
+	if got := p.order(); !reflect.DeepEqual(got, []int{msgLaneHigh, msgLaneNormal, msgLaneLow}) {
+		t.Fatalf("order after low = %v", got)
+	}
+}
+
+func TestPriorityPickerSort(t *testing.T) {
+	h1, h2, h3 := Msg{ID: "h1", Priority: MsgPriorityHigh}, Msg{ID: "h2", Priority: MsgPriorityHigh}, Msg{ID: "h3", Priority: MsgPriorityHigh}
+	n1 := Msg{ID: "n1"}
+	l1, l2 := Msg{ID: "l1", Priority: MsgPriorityLow}, Msg{ID: "l2", Priority: MsgPriorityLow}
+	tests := []struct {
+		burst int
+		msgs  []Msg
+		want  []string
+	}{
+		{2, []Msg{l1, n1, h1, h2, h3}, []string{"h1", "h2", "n1", "h3", "l1"}},
+		{1, []Msg{h1, h2, l1, l2}, []string{"h1", "l1", "h2", "l2"}},
+		{10, []Msg{l1, n1, h1}, []string{"h1", "n1", "l1"}},
+		{2, nil, []string{}},
+	}
+	for _, tt := range tests {
+		p := &priorityPicker{burst: tt.burst}
+		if got := msgIds(p.sort(tt.msgs)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("burst %d sort(%v) = %v, want %v", tt.burst, msgIds(tt.msgs), got, tt.want)
+		}
+	}
+}
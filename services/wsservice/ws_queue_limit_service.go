@@ -0,0 +1,126 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+// 用户消息队列达到上限时的处理策略，上限为用户所有优先级通道的消息总数
+const (
+	// 删除最旧的消息
+	QueueFullDropOldest = "drop_oldest"
+	// 拒绝写入，发送接口返回队列已满
+	QueueFullReject = "reject"
+)
+
+const (
+	// 各用户队列的长度，成员为用户ID，入队、取出和确认stream消息时更新
+	msgQueueDepthKey = "ws_user_msg_queue_depth"
+	// 统计返回的最长队列数
+	msgQueueStatsTop = 10
+)
+
+// 用户各优先级队列的长度
+type UserQueueStats struct {
+	UID     int            `json:"uid"`
+	Queue   map[string]int `json:"queue"`   // 按优先级的待推送消息数
+	Delay   int            `json:"delay"`   // 等待ACK或重试的消息数
+	Offline int            `json:"offline"` // 离线消息数
+}
+
+// 所有用户队列的统计
+type QueueStats struct {
+	Ready  int          `json:"ready"`  // 等待分发的用户通知数
+	Delay  int          `json:"delay"`  // 有延迟消息的用户数
+	Queues int          `json:"queues"` // 有待推送消息的用户数
+	Top    []QueueDepth `json:"top"`    // 队列最长的用户
+}
+
+type QueueDepth struct {
+	UID   int `json:"uid"`
+	Depth int `json:"depth"`
+}
+
+// 各通道的名称
+var msgLaneName = [msgPriorityLanes]string{"high", "normal", "low"}
+
+// 超出队列上限被删除的消息记录状态
+func dropQueueOverflow(userId int, dropped []string) {
+	for _, data := range dropped {
+		var msg Msg
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			continue
+		}
+		_ = msg.UpdateMsgStatus(MsgStatusDropped, "", "queue full")
+		logger.Logger.Warn("websocket user msg queue is full, drop oldest msg", zap.Int("user_id", userId), zap.String("msg_id", msg.ID))
+	}
+}
+
+// 获取用户各队列的长度
+func GetUserQueueStats(userId int) (stats UserQueueStats, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	lenCmd := "lLen"
+	if useStreamInbox() {
+		lenCmd = "xLen"
+	}
+	for _, cacheKey := range userQueueKeys(userId) {
+		rd.Send(lenCmd, cacheKey)
+	}
+	uid := strconv.Itoa(userId)
+	rd.Send("zCard", msgDelayQueuePreCacheKey+uid)
+	rd.Send("zCard", msgOfflinePreCacheKey+uid)
+	if err = rd.Flush(); err != nil {
+		logger.Logger.Warn("get websocket user queue stats failed", zap.Int("user_id", userId), zap.Error(err))
+		return
+	}
+
+	stats = UserQueueStats{UID: userId, Queue: make(map[string]int, msgPriorityLanes)}
+	for lane := 0; lane < msgPriorityLanes; lane++ {
+		stats.Queue[msgLaneName[lane]], _ = redis.Int(rd.Receive())
+	}
+	stats.Delay, _ = redis.Int(rd.Receive())
+	stats.Offline, err = redis.Int(rd.Receive())
+	if err != nil {
+		logger.Logger.Warn("get websocket user queue stats failed", zap.Int("user_id", userId), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 获取所有用户队列的统计及最长的队列
+func GetQueueStats() (stats QueueStats, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	rd.Send("lLen", msgReadyListKey)
+	rd.Send("zCard", msgDelayIndexKey)
+	rd.Send("zCard", msgQueueDepthKey)
+	rd.Send("zRevRange", msgQueueDepthKey, 0, msgQueueStatsTop-1, "WITHSCORES")
+	if err = rd.Flush(); err != nil {
+		logger.Logger.Warn("get websocket queue stats failed", zap.Error(err))
+		return
+	}
+
+	stats.Ready, _ = redis.Int(rd.Receive())
+	stats.Delay, _ = redis.Int(rd.Receive())
+	stats.Queues, _ = redis.Int(rd.Receive())
+	var top []string
+	top, err = redis.Strings(rd.Receive())
+	if err != nil {
+		logger.Logger.Warn("get websocket queue stats failed", zap.Error(err))
+		return
+	}
+	stats.Top = make([]QueueDepth, 0, len(top)/2)
+	for i := 0; i+1 < len(top); i += 2 {
+		uid, _ := strconv.Atoi(top[i])
+		depth, _ := strconv.Atoi(top[i+1])
+		stats.Top = append(stats.Top, QueueDepth{UID: uid, Depth: depth})
+	}
+	return
+}
@@ -0,0 +1,189 @@
+package wsservice
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
+	"go-ws/utils/http"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 客户端ACK类型
+const (
+	// 已收到，类型为空时同样视为已收到
+	RecMsgTypeDelivered = "delivered"
+	// 已读
+	RecMsgTypeRead = "read"
+	// 已忽略，如通知被划掉
+	RecMsgTypeDismissed = "dismissed"
+)
+
+// 服务端推送的消息类型
+const (
+	// 已读回执，推送给消息的发送者
+	MsgTypeReceipt = "receipt"
+)
+
+const (
+	// 用户已读消息的最大序号
+	msgReadSeqPreCacheKey = "ws_user_msg_read_seq:"
+)
+
+// 已读回执内容
+type MsgReceipt struct {
+	MsgId  string `json:"msg_id"`
+	UID    int    `json:"uid"` // 已读的用户
+	Seq    int64  `json:"seq,omitempty"`
+	State  string `json:"state"`
+	ConnId string `json:"conn_id"`
+	Time   int64  `json:"time"`
+}
+
+// 处理客户端的ACK，ID确认单条消息，Seq确认序号不大于Seq的所有消息
+func (w *WsUserConnInfo) HandleAck(recMsg RecMsg) {
+	switch recMsg.Type {
+	case "", RecMsgTypeDelivered:
+		if recMsg.ID != "" {
+			// 保存消息的ack
+			_ = AddMsgAck(w.UID, recMsg.ID, w.ID)
+			_ = Msg{ID: recMsg.ID, UID: w.UID}.UpdateMsgStatus(MsgStatusAcked, w.ID, "")
+		}
+		if recMsg.Seq > 0 {
+			w.ackDeliveredSeq(recMsg.Seq)
+		}
+	case RecMsgTypeRead, RecMsgTypeDismissed:
+		state := MsgStatusRead
+		if recMsg.Type == RecMsgTypeDismissed {
+			state = MsgStatusDismissed
+		}
+		var msgs []Msg
+		if recMsg.ID != "" {
+			// 已读同样表示已收到，不再重推
+			_ = AddMsgAck(w.UID, recMsg.ID, w.ID)
+			if msg, ok := getReceiptMsg(w.UID, recMsg.ID); ok {
+				msgs = append(msgs, msg)
+			}
+		}
+		if recMsg.Seq > 0 {
+			w.ackDeliveredSeq(recMsg.Seq)
+			msgs = append(msgs, w.getUnreadMsgs(recMsg.Seq)...)
+		}
+		for _, msg := range msgs {
+			_ = msg.UpdateMsgStatus(state, w.ID, "")
+			if state == MsgStatusRead {
+				msg.sendReadReceipt(w)
+			}
+		}
+	}
+}
+
+// 累计确认已收到的序号，重推前检查
+func (w *WsUserConnInfo) ackDeliveredSeq(seq int64) {
+	for {
+		prev := atomic.LoadInt64(&w.DeliveredSeq)
+		if seq <= prev {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&w.DeliveredSeq, prev, seq) {
+			break
+		}
+	}
+
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	// 其他服务器重推前从redis读取
+	_, err := rd.Do("hSet", WsUserConnInfoPreCacheKey+w.ID, "DeliveredSeq", seq)
+	if err != nil {
+		logger.Logger.Warn("update websocket user conn delivered seq failed", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.Int64("seq", seq), zap.Error(err))
+	}
+}
+
+// 更新用户已读的最大序号，返回上次已读序号之后到seq之间的消息
+func (w *WsUserConnInfo) getUnreadMsgs(seq int64) (msgs []Msg) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	luaScript := `
+	local prev = tonumber(redis.call('GET', KEYS[1]) or '0')
+	if tonumber(ARGV[1]) > prev then
+		redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2])
+	end
+	return prev
+	`
+
+	script := redis.NewScript(1, luaScript)
+	cacheKey := msgReadSeqPreCacheKey + strconv.Itoa(w.UID)
+	prev, err := redis.Int64(script.Do(rd, cacheKey, seq, config.Settings.Websocket.MsgLogTTL))
+	if err != nil {
+		logger.Logger.Warn("update websocket user read seq failed", zap.Int("user_id", w.UID), zap.Int64("seq", seq), zap.Error(err))
+		return
+	}
+	if seq <= prev {
+		return
+	}
+
+	msgs, _ = GetWsMsgLog(w.UID, prev+1, seq)
+	return
+}
+
+// 按消息ID获取回执需要的消息信息，消息不属于该用户时忽略，避免给其他用户消息的发送者推送回执
+func getReceiptMsg(userId int, msgId string) (msg Msg, ok bool) {
+	msg = Msg{ID: msgId, UID: userId}
+	status, err := GetMsgStatus(msgId)
+	if err != nil {
+		// 未记录状态的消息没有发送者，只回调
+		return msg, err == errs.ErrMsgStatusNotFound
+	}
+	if status.UID != userId {
+		logger.Logger.Warn("websocket msg receipt uid mismatch", zap.Int("user_id", userId), zap.String("msg_id", msgId), zap.Int("msg_uid", status.UID))
+		return msg, false
+	}
+	msg.From = status.From
+	return msg, true
+}
+
+// 已读回执推送给消息的发送者，并回调配置的地址
+func (m Msg) sendReadReceipt(w *WsUserConnInfo) {
+	// 回执消息不再产生回执
+	if m.Type == MsgTypeReceipt {
+		return
+	}
+
+	receipt := MsgReceipt{
+		MsgId:  m.ID,
+		UID:    w.UID,
+		Seq:    m.Seq,
+		State:  MsgStatusRead,
+		ConnId: w.ID,
+		Time:   time.Now().Unix(),
+	}
+
+	if m.From > 0 {
+		msg := Msg{
+			ID:      strconv.FormatInt(receipt.Time, 10) + "-receipt-" + m.ID,
+			UID:     m.From,
+			Type:    MsgTypeReceipt,
+			Content: receipt,
+		}
+		_ = msg.PushWsMsgToQueue()
+	}
+
+	if webhook := config.Settings.Websocket.ReceiptWebhook; webhook != "" {
+		var data = url.Values{}
+		data.Add("msg_id", receipt.MsgId)
+		data.Add("uid", strconv.Itoa(receipt.UID))
+		data.Add("from", strconv.Itoa(m.From))
+		data.Add("seq", strconv.FormatInt(receipt.Seq, 10))
+		data.Add("state", receipt.State)
+		data.Add("conn_id", receipt.ConnId)
+		data.Add("time", strconv.FormatInt(receipt.Time, 10))
+		go http.Notify(webhook, data)
+	}
+}
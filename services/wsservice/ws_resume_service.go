@@ -0,0 +1,180 @@
+package wsservice
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+const (
+	// 断线重连使用的token，值为链接ID
+	wsUserResumeTokenPreCacheKey = "ws_user_resume_token:"
+	// 链接存活期间token的过期时间(s)，断开后缩短为重连宽限时间
+	wsUserResumeTokenTTL = 86400
+)
+
+// 链接建立后推送的第一条消息，浏览器无法读取握手响应头，通过消息下发重连token
+const MsgTypeSession = "session"
+
+// 链接信息
+type SessionInfo struct {
+	ConnId      string `json:"conn_id"`
+	ResumeToken string `json:"resume_token"`
+	Resumed     bool   `json:"resumed"` // 是否接管了旧链接
+}
+
+// 生成重连token
+func NewResumeToken() string {
+	return uuid.New().String()
+}
+
+// 保存重连token
+func SaveResumeToken(token, userConnId string, ttl int) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := wsUserResumeTokenPreCacheKey + token
+	_, err = rd.Do("set", cacheKey, userConnId, "EX", ttl)
+	if err != nil {
+		logger.Logger.Warn("save websocket resume token failed", zap.String("user_conn_id", userConnId), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 获取并删除重连token，token只能使用一次
+func takeResumeToken(token string) (userConnId string, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := wsUserResumeTokenPreCacheKey + token
+	rd.Send("MULTI")
+	rd.Send("get", cacheKey)
+	rd.Send("del", cacheKey)
+	var reply []interface{}
+	reply, err = redis.Values(rd.Do("EXEC"))
+	if err != nil {
+		logger.Logger.Warn("get websocket resume token failed", zap.String("token", token), zap.Error(err))
+		return
+	}
+
+	return redis.String(reply[0], nil)
+}
+
+// 校验重连token，返回可接管的旧链接，旧链接未断开时先关闭
+func GetResumableUserConn(userId int, token string) (w *WsUserConnInfo, err error) {
+	var userConnId string
+	userConnId, err = takeResumeToken(token)
+	if err != nil {
+		err = errs.ErrWebSocketResumeTokenInvalid
+		return
+	}
+
+	w, err = GetWsUserConnInfo(userConnId)
+	if err != nil || w.UID != userId {
+		logger.Logger.Warn("websocket resume conn not found", zap.Int("user_id", userId), zap.String("user_conn_id", userConnId), zap.Error(err))
+		err = errs.ErrWebSocketResumeTokenInvalid
+		return
+	}
+
+	// 旧链接可能还没检测到断开，由所在的服务器关闭
+	if !w.Closed {
+		if err = CloseUserConn(w, errs.CloseSessionResumed); err != nil {
+			logger.Logger.Warn("close websocket resume conn failed", zap.Int("user_id", userId), zap.String("user_conn_id", w.ID), zap.Error(err))
+			return
+		}
+	}
+
+	return
+}
+
+// 接管旧链接：沿用链接ID和推送序号，lastSeq之前的消息视为已收到，其余未ACK的消息立即重推
+func (w *WsUserConnInfo) Resume(prev *WsUserConnInfo, lastSeq int64) {
+	w.ID = prev.ID
+	w.wsConnection.ID = prev.ID
+	w.Seq = prev.Seq
+	w.AckSeq = prev.AckSeq
+	w.DeliveredSeq = prev.DeliveredSeq
+	if lastSeq > w.AckSeq && lastSeq <= prev.Seq {
+		w.AckSeq = lastSeq
+	}
+
+	go RetryWsMsgDelayQueueNow(w.UID, w.ID)
+
+	logger.Logger.Info("resume websocket user conn", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.Int64("seq", w.Seq), zap.Int64("ack_seq", w.AckSeq))
+}
+
+// 推送链接信息，需要在Register之前调用，保证是链接收到的第一条消息
+func (w *WsUserConnInfo) SendSessionInfo(resumed bool) (err error) {
+	msg := Msg{
+		ID:      NewMsgId(),
+		UID:     w.UID,
+		Type:    MsgTypeSession,
+		ConnId:  w.ID,
+		Content: SessionInfo{ConnId: w.ID, ResumeToken: w.ResumeToken, Resumed: resumed},
+	}
+	data, err := w.wsConnection.Codec.Marshal(msg)
+	if err != nil {
+		logger.Logger.Warn("websocket session msg encode failed", zap.String("user_conn_id", w.ID), zap.String("codec", w.Codec), zap.Error(err))
+		return
+	}
+	// 不记录原消息，下线时不重新入队
+	return w.enqueue(wsFrame{data: data, lane: msgLaneHigh})
+}
+
+// 链接断开后token只在宽限时间内有效，token已被使用时不再保存
+func (w *WsUserConnInfo) expireResumeToken() {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := wsUserResumeTokenPreCacheKey + w.ResumeToken
+	_, err := rd.Do("expire", cacheKey, config.Settings.Websocket.ResumeGrace)
+	if err != nil {
+		logger.Logger.Warn("expire websocket resume token failed", zap.String("user_conn_id", w.ID), zap.Error(err))
+	}
+}
+
+// 删除链接的重连token，链接关闭后不能再被接管
+func (w *WsUserConnInfo) revokeResumeToken() (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	_, err = rd.Do("del", wsUserResumeTokenPreCacheKey+w.ResumeToken)
+	if err != nil {
+		logger.Logger.Warn("revoke websocket resume token failed", zap.String("user_conn_id", w.ID), zap.Error(err))
+	}
+	return
+}
+
+// 将延迟队列里某个链接的消息改为立即重推，只处理链接的消息列表中仍在延迟队列的消息
+func RetryWsMsgDelayQueueNow(userId int, userConnId string) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	luaScript := `
+	local count = 0
+	for _, message in ipairs(redis.call('SMEMBERS', KEYS[3])) do
+		count = count + redis.call('ZADD', KEYS[1], 'XX', 'CH', ARGV[1], message)
+	end
+	redis.call('DEL', KEYS[3])
+	if count > 0 then
+		redis.call('ZADD', KEYS[2], ARGV[1], ARGV[2])
+	end
+	return count
+	`
+
+	script := redis.NewScript(3, luaScript)
+	cacheKey := msgDelayQueuePreCacheKey + strconv.Itoa(userId)
+	_, err = script.Do(rd, cacheKey, msgDelayIndexKey, msgDelayConnPreCacheKey+userConnId, time.Now().Unix(), userId)
+	if err != nil {
+		logger.Logger.Warn("retry websocket delay queue msg failed", zap.Int("user_id", userId), zap.String("user_conn_id", userConnId), zap.Error(err))
+		return
+	}
+	return
+}
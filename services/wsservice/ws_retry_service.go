@@ -0,0 +1,273 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"go-ws/config"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 重试间隔的计算方式
+const (
+	// 固定间隔
+	BackoffFixed = "fixed"
+	// 指数增长
+	BackoffExponential = "exponential"
+)
+
+// 进入死信队列的原因
+const (
+	// 重试次数用完仍未收到ACK
+	DeadLetterRetriesExhausted = "retries_exhausted"
+	// 链接已关闭且超过断线重连的宽限时间
+	DeadLetterConnectionClosed = "connection_closed"
+	// 链接信息不存在
+	DeadLetterConnectionNotFound = "connection_not_found"
+	// 定时推送多次写入用户的消息队列失败，如队列已满拒绝写入
+	DeadLetterEnqueueFailed = "enqueue_failed"
+)
+
+const (
+	// 用户死信消息，值为DeadLetter
+	msgDeadLetterPreCacheKey = "ws_user_msg_dead_letter:"
+)
+
+// 消息重试策略，未设置的字段使用配置中的默认值
+type BackoffPolicy struct {
+	Type        string  `json:"type,omitempty" form:"backoff"`                    // fixed或exponential
+	Interval    int     `json:"interval,omitempty" form:"retry_interval"`         // 首次重试间隔(s)
+	Multiplier  float64 `json:"multiplier,omitempty" form:"retry_multiplier"`     // 指数增长的倍数
+	MaxInterval int     `json:"max_interval,omitempty" form:"retry_max_interval"` // 最大重试间隔(s)
+	Jitter      float64 `json:"jitter,omitempty" form:"retry_jitter"`             // 随机抖动比例，0到1
+}
+
+// 死信消息
+type DeadLetter struct {
+	Msg    Msg    `json:"msg"`
+	ConnId string `json:"conn_id"` // 最后推送的链接
+	Reason string `json:"reason"`
+	Time   int64  `json:"time"`
+}
+
+// 默认重试策略
+func defaultBackoffPolicy() BackoffPolicy {
+	return BackoffPolicy{
+		Type:        config.Settings.Websocket.RetryBackoff,
+		Interval:    config.Settings.Websocket.RetryInterval,
+		Multiplier:  config.Settings.Websocket.RetryMultiplier,
+		MaxInterval: config.Settings.Websocket.RetryMaxInterval,
+		Jitter:      config.Settings.Websocket.RetryJitter,
+	}
+}
+
+// 消息的重试策略，消息未设置的字段使用默认值
+func (m Msg) backoffPolicy() BackoffPolicy {
+	p := defaultBackoffPolicy()
+	if m.Backoff == nil {
+		return p
+	}
+	if m.Backoff.Type != "" {
+		p.Type = m.Backoff.Type
+	}
+	if m.Backoff.Interval > 0 {
+		p.Interval = m.Backoff.Interval
+	}
+	if m.Backoff.Multiplier > 0 {
+		p.Multiplier = m.Backoff.Multiplier
+	}
+	if m.Backoff.MaxInterval > 0 {
+		p.MaxInterval = m.Backoff.MaxInterval
+	}
+	if m.Backoff.Jitter > 0 {
+		p.Jitter = m.Backoff.Jitter
+	}
+	return p
+}
+
+// 第attempt次重试前的等待时间(s)，attempt从0开始
+func (p BackoffPolicy) Delay(attempt int) int64 {
+	delay := float64(p.Interval)
+	if p.Type == BackoffExponential {
+		delay = delay * math.Pow(p.Multiplier, float64(attempt))
+	}
+	if p.MaxInterval > 0 && delay > float64(p.MaxInterval) {
+		delay = float64(p.MaxInterval)
+	}
+	if p.Jitter > 0 {
+		delay = delay * (1 + p.Jitter*(rand.Float64()*2-1))
+	}
+	if delay < 1 {
+		delay = 1
+	}
+	return int64(math.Round(delay))
+}
+
+// 下次检查ACK的时间
+func (m Msg) nextRetryTime() int64 {
+	return time.Now().Unix() + m.backoffPolicy().Delay(m.Attempt)
+}
+
+// 消息写入死信队列
+func (m Msg) SaveDeadLetter(reason string) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	deadLetter := DeadLetter{
+		Msg:    m,
+		ConnId: m.ConnId,
+		Reason: reason,
+		Time:   time.Now().Unix(),
+	}
+	var data []byte
+	data, _ = json.Marshal(deadLetter)
+
+	cacheKey := msgDeadLetterPreCacheKey + strconv.Itoa(m.UID)
+	rd.Send("MULTI")
+	rd.Send("hSet", cacheKey, m.ID, string(data))
+	rd.Send("expire", cacheKey, config.Settings.Websocket.DeadLetterTTL)
+	_, err = rd.Do("EXEC")
+	if err != nil {
+		logger.Logger.Warn("save websocket dead letter failed", zap.Any("msg", m), zap.String("reason", reason), zap.Error(err))
+		return
+	}
+
+	go m.UpdateMsgStatus(MsgStatusDeadLettered, m.ConnId, reason)
+
+	logger.Logger.Info("save websocket dead letter success", zap.Any("msg", m), zap.String("reason", reason))
+	return
+}
+
+// 获取用户的死信消息，按进入时间倒序分页
+func GetDeadLetterList(userId int, offset, limit int) (list []DeadLetter, total int, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgDeadLetterPreCacheKey + strconv.Itoa(userId)
+	var values []string
+	values, err = redis.Strings(rd.Do("hVals", cacheKey))
+	if err != nil {
+		logger.Logger.Warn("get websocket dead letter list failed", zap.String("cacheKey", cacheKey), zap.Error(err))
+		return
+	}
+
+	all := make([]DeadLetter, 0, len(values))
+	for _, value := range values {
+		var deadLetter DeadLetter
+		if json.Unmarshal([]byte(value), &deadLetter) == nil {
+			all = append(all, deadLetter)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Time > all[j].Time
+	})
+
+	total = len(all)
+	if offset >= total {
+		return []DeadLetter{}, total, nil
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	list = all[offset:end]
+	return
+}
+
+// 获取某条死信消息
+func GetDeadLetter(userId int, msgId string) (deadLetter DeadLetter, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgDeadLetterPreCacheKey + strconv.Itoa(userId)
+	var data []byte
+	data, err = redis.Bytes(rd.Do("hGet", cacheKey, msgId))
+	if err == redis.ErrNil {
+		err = errs.ErrDeadLetterNotFound
+		return
+	}
+	if err != nil {
+		logger.Logger.Warn("get websocket dead letter failed", zap.String("cacheKey", cacheKey), zap.String("msg_id", msgId), zap.Error(err))
+		return
+	}
+
+	err = json.Unmarshal(data, &deadLetter)
+	return
+}
+
+// 重新推送死信消息，msgIds为空时重推用户的所有死信消息，返回重推的数量
+func ReplayDeadLetter(userId int, msgIds []string) (count int, err error) {
+	var list []DeadLetter
+	if len(msgIds) == 0 {
+		list, _, err = GetDeadLetterList(userId, 0, math.MaxInt32)
+		if err != nil {
+			return
+		}
+	} else {
+		for _, msgId := range msgIds {
+			var deadLetter DeadLetter
+			deadLetter, err = GetDeadLetter(userId, msgId)
+			if err != nil {
+				return
+			}
+			list = append(list, deadLetter)
+		}
+	}
+
+	// 按序号重新入队，恢复原有的重试次数
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Msg.Seq < list[j].Msg.Seq
+	})
+	for _, deadLetter := range list {
+		msg := deadLetter.Msg
+		msg.Retries, msg.Attempt = msg.Retries+msg.Attempt, 0
+		msg.ConnId, msg.ConnSeq, msg.StreamId = "", 0, ""
+		// 先恢复状态，否则死信为最终状态，重推后的分发和ACK无法记录
+		var reset bool
+		if reset, err = msg.resetDeadLetterStatus(); err != nil {
+			return
+		}
+		// 写入队列和删除死信在同一脚本中完成，并发重推时只有一次生效
+		err = msg.enqueue(true)
+		if err == errs.ErrDeadLetterNotFound {
+			err = nil
+			continue
+		}
+		if err != nil {
+			if reset {
+				_ = msg.UpdateMsgStatus(MsgStatusDeadLettered, deadLetter.ConnId, deadLetter.Reason)
+			}
+			return
+		}
+		count++
+	}
+	return
+}
+
+// 删除死信消息，msgIds为空时删除用户的所有死信消息，返回删除的数量
+func PurgeDeadLetter(userId int, msgIds []string) (count int, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	cacheKey := msgDeadLetterPreCacheKey + strconv.Itoa(userId)
+	if len(msgIds) == 0 {
+		count, err = redis.Int(rd.Do("hLen", cacheKey))
+		if err == nil {
+			_, err = rd.Do("del", cacheKey)
+		}
+	} else {
+		count, err = redis.Int(rd.Do("hDel", redis.Args{}.Add(cacheKey).AddFlat(msgIds)...))
+	}
+	if err != nil {
+		logger.Logger.Warn("purge websocket dead letter failed", zap.String("cacheKey", cacheKey), zap.Strings("msg_ids", msgIds), zap.Error(err))
+		return
+	}
+	return
+}
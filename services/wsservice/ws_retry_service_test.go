@@ -0,0 +1,57 @@
+package wsservice
+
+import (
+	"go-ws/config"
+	"testing"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		policy BackoffPolicy
+		want   []int64
+	}{
+		{BackoffPolicy{Type: BackoffFixed, Interval: 5}, []int64{5, 5, 5}},
+		{BackoffPolicy{Type: BackoffExponential, Interval: 2, Multiplier: 2, MaxInterval: 30}, []int64{2, 4, 8, 16, 30, 30}},
+		{BackoffPolicy{Type: BackoffExponential, Interval: 3, Multiplier: 1.5}, []int64{3, 5, 7}},
+		// 间隔至少1秒
+		{BackoffPolicy{Type: BackoffFixed}, []int64{1, 1}},
+	}
+	for _, tt := range tests {
+		for attempt, want := range tt.want {
+			if got := tt.policy.Delay(attempt); got != want {
+				t.Errorf("%+v Delay(%d) = %d, want %d", tt.policy, attempt, got, want)
+			}
+		}
+	}
+}
+
+// 抖动后的间隔在interval*(1±jitter)之间
+func TestBackoffDelayJitter(t *testing.T) {
+	p := BackoffPolicy{Type: BackoffFixed, Interval: 10, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := p.Delay(0); got < 5 || got > 15 {
+			t.Fatalf("Delay(0) = %d, want between 5 and 15", got)
+		}
+	}
+}
+
+// 消息未设置的字段使用配置中的默认值
+func TestMsgBackoffPolicy(t *testing.T) {
+	prev := config.Settings
+	t.Cleanup(func() { config.Settings = prev })
+	config.Settings = &config.Config{}
+	config.Settings.Websocket.RetryBackoff = BackoffExponential
+	config.Settings.Websocket.RetryInterval = 2
+	config.Settings.Websocket.RetryMultiplier = 2
+	config.Settings.Websocket.RetryMaxInterval = 60
+
+	if got, want := (Msg{}).backoffPolicy(), defaultBackoffPolicy(); got != want {
+		t.Errorf("default policy = %+v, want %+v", got, want)
+	}
+
+	msg := Msg{Backoff: &BackoffPolicy{Type: BackoffFixed, Interval: 10}}
+	want := BackoffPolicy{Type: BackoffFixed, Interval: 10, Multiplier: 2, MaxInterval: 60}
+	if got := msg.backoffPolicy(); got != want {
+		t.Errorf("msg policy = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,346 @@
+package wsservice
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/cron"
+	"go-ws/utils/errs"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// 所有定时推送，值为MsgSchedule
+	msgScheduleListKey = "ws_msg_schedule_list"
+	// 定时推送队列，分值为下次推送时间
+	msgScheduleQueueKey = "ws_msg_schedule_queue"
+	// 定时推送的执行节点，只有持有锁的实例推送
+	msgSchedulerLeaderKey = "ws_msg_scheduler_leader"
+	// 执行节点锁的过期时间(s)，实例宕机后由其他实例接管
+	msgSchedulerLeaderTTL = 10
+	// 每次取出的最大到期数
+	msgScheduleBatchSize = 100
+	// 取出的定时推送在该时间(s)内未完成时重新推送，执行节点宕机或redis出错时不丢失
+	msgScheduleLease = 60
+	// 写入用户的消息队列失败的最大重试次数，超过后进入死信队列
+	msgScheduleMaxAttempts = 10
+	// 写入失败后重试的最大间隔(s)
+	msgScheduleMaxRetryInterval = 60
+)
+
+// 定时推送
+type MsgSchedule struct {
+	ID          string `json:"id"`
+	Msg         Msg    `json:"msg"`                    // 推送的消息，周期推送每次使用新的消息ID
+	Cron        string `json:"cron,omitempty"`         // 周期推送的cron表达式：分 时 日 月 周，为空时只推送一次
+	DeliverAt   int64  `json:"deliver_at"`             // 下次推送时间
+	Ttl         int64  `json:"ttl,omitempty"`          // 消息的有效时长(s)，从每次推送的时间开始计算
+	Attempts    int    `json:"attempts,omitempty"`     // 本次推送写入失败的次数
+	CallbackUrl string `json:"callback_url,omitempty"` // 消息状态变更的回调地址
+	CreatedAt   int64  `json:"created_at"`
+	UpdatedAt   int64  `json:"updated_at"`
+}
+
+// 写入失败后下次重试的间隔(s)，按失败次数指数增长
+func (s *MsgSchedule) retryDelay() int64 {
+	return int64(math.Min(math.Pow(2, float64(s.Attempts)), msgScheduleMaxRetryInterval))
+}
+
+// 计算下次推送时间，周期推送按cron表达式计算，一次性推送使用指定的时间
+// 推送时消息已过期的返回错误，周期推送到期后不再推送
+func (s *MsgSchedule) next(now time.Time) error {
+	if s.Cron == "" {
+		if s.DeliverAt <= 0 {
+			return errs.ErrMsgScheduleInvalid
+		}
+	} else {
+		spec, err := cron.Parse(s.Cron)
+		if err != nil {
+			return errs.ErrMsgScheduleInvalid
+		}
+		next := spec.Next(now)
+		if next.IsZero() {
+			return errs.ErrMsgScheduleInvalid
+		}
+		s.DeliverAt = next.Unix()
+	}
+	if s.Msg.ExpiresAt > 0 && s.Msg.ExpiresAt <= s.DeliverAt {
+		return errs.ErrMsgScheduleInvalid
+	}
+	return nil
+}
+
+// 保存定时推送
+func (s *MsgSchedule) save() (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	var data []byte
+	data, _ = json.Marshal(s)
+
+	rd.Send("MULTI")
+	rd.Send("hSet", msgScheduleListKey, s.ID, string(data))
+	rd.Send("zAdd", msgScheduleQueueKey, s.DeliverAt, s.ID)
+	_, err = rd.Do("EXEC")
+	if err != nil {
+		logger.Logger.Warn("save websocket msg schedule failed", zap.Any("schedule", s), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 添加定时推送
+func AddMsgSchedule(s *MsgSchedule) (err error) {
+	now := time.Now()
+	if err = s.next(now); err != nil {
+		return
+	}
+	s.ID = uuid.New().String()
+	s.CreatedAt = now.Unix()
+	s.UpdatedAt = now.Unix()
+	if s.Msg.ID == "" {
+		s.Msg.ID = NewMsgId()
+	}
+	if err = s.save(); err != nil {
+		return
+	}
+
+	logger.Logger.Info("add websocket msg schedule success", zap.Any("schedule", s))
+	return
+}
+
+// 获取定时推送
+func GetMsgSchedule(id string) (s MsgSchedule, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	var data []byte
+	data, err = redis.Bytes(rd.Do("hGet", msgScheduleListKey, id))
+	if err == redis.ErrNil {
+		err = errs.ErrMsgScheduleNotFound
+		return
+	}
+	if err != nil {
+		logger.Logger.Warn("get websocket msg schedule failed", zap.String("id", id), zap.Error(err))
+		return
+	}
+
+	err = json.Unmarshal(data, &s)
+	return
+}
+
+// 获取定时推送列表，userId为0时返回全部，按下次推送时间排序
+func GetMsgScheduleList(userId int) (list []MsgSchedule, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	var values []string
+	values, err = redis.Strings(rd.Do("hVals", msgScheduleListKey))
+	if err != nil {
+		logger.Logger.Warn("get websocket msg schedule list failed", zap.Error(err))
+		return
+	}
+
+	list = make([]MsgSchedule, 0, len(values))
+	for _, value := range values {
+		var s MsgSchedule
+		if json.Unmarshal([]byte(value), &s) != nil {
+			continue
+		}
+		if userId == 0 || s.Msg.UID == userId {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DeliverAt < list[j].DeliverAt
+	})
+	return
+}
+
+// 更新定时推送，重新计算下次推送时间
+func UpdateMsgSchedule(s *MsgSchedule) (err error) {
+	if _, err = GetMsgSchedule(s.ID); err != nil {
+		return
+	}
+	if err = s.next(time.Now()); err != nil {
+		return
+	}
+	s.UpdatedAt = time.Now().Unix()
+	if err = s.save(); err != nil {
+		return
+	}
+
+	logger.Logger.Info("update websocket msg schedule success", zap.Any("schedule", s))
+	return
+}
+
+// 取消定时推送
+func CancelMsgSchedule(id string) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	rd.Send("MULTI")
+	rd.Send("hDel", msgScheduleListKey, id)
+	rd.Send("zRem", msgScheduleQueueKey, id)
+	var reply []interface{}
+	reply, err = redis.Values(rd.Do("EXEC"))
+	if err != nil {
+		logger.Logger.Warn("cancel websocket msg schedule failed", zap.String("id", id), zap.Error(err))
+		return
+	}
+	if n, _ := redis.Int(reply[0], nil); n == 0 {
+		return errs.ErrMsgScheduleNotFound
+	}
+
+	logger.Logger.Info("cancel websocket msg schedule success", zap.String("id", id))
+	return
+}
+
+// 启动定时推送，各实例竞争执行节点锁，只有一个实例把到期的消息写入用户的消息队列
+func StartScheduler() {
+	go func() {
+		var token string
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if IsDraining() {
+				if token != "" {
+					releaseLock(msgSchedulerLeaderKey, token)
+				}
+				return
+			}
+
+			if token == "" {
+				var ok bool
+				if token, ok = acquireLock(msgSchedulerLeaderKey, msgSchedulerLeaderTTL); !ok {
+					continue
+				}
+				logger.Logger.Info("websocket msg scheduler elected", zap.String("instance", localInstance))
+			} else if !renewLock(msgSchedulerLeaderKey, token, msgSchedulerLeaderTTL) {
+				logger.Logger.Warn("websocket msg scheduler lost leadership", zap.String("instance", localInstance))
+				token = ""
+				continue
+			}
+
+			fireDueMsgSchedules()
+		}
+	}()
+}
+
+// 推送到期的定时消息
+func fireDueMsgSchedules() {
+	for {
+		ids, err := popDueMsgScheduleIds()
+		if err != nil || len(ids) == 0 {
+			return
+		}
+		for _, id := range ids {
+			fireMsgSchedule(id)
+		}
+		if len(ids) < msgScheduleBatchSize {
+			return
+		}
+	}
+}
+
+// 取出到期的定时推送ID，不从队列删除，推迟到租期后，推送完成后再更新
+func popDueMsgScheduleIds() (ids []string, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	luaScript := `
+	local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+	for _, id in ipairs(ids) do
+		redis.call('ZADD', KEYS[1], ARGV[1] + ARGV[3], id)
+	end
+	return ids
+	`
+
+	script := redis.NewScript(1, luaScript)
+	ids, err = redis.Strings(script.Do(rd, msgScheduleQueueKey, time.Now().Unix(), msgScheduleBatchSize, msgScheduleLease))
+	if err != nil {
+		logger.Logger.Warn("pop websocket msg schedule failed", zap.Error(err))
+		return
+	}
+	return
+}
+
+// 推送后更新定时推送，推送期间被取消或修改时不覆盖
+// 周期推送保存下次推送时间，一次性推送删除，data为空时只删除
+var finishMsgScheduleScript = redis.NewScript(2, `
+	if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+		return 0
+	end
+	if ARGV[3] == '' then
+		redis.call('HDEL', KEYS[1], ARGV[1])
+		redis.call('ZREM', KEYS[2], ARGV[1])
+		return 1
+	end
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+	redis.call('ZADD', KEYS[2], ARGV[4], ARGV[1])
+	return 1
+	`)
+
+// 定时消息写入用户的消息队列，周期推送计算下次推送时间，一次性推送完成后删除
+func fireMsgSchedule(id string) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	prev, err := redis.String(rd.Do("hGet", msgScheduleListKey, id))
+	if err == redis.ErrNil {
+		// 已取消的定时推送
+		_, _ = rd.Do("zRem", msgScheduleQueueKey, id)
+		return
+	}
+	if err != nil {
+		logger.Logger.Warn("get websocket msg schedule failed", zap.String("id", id), zap.Error(err))
+		return
+	}
+	var s MsgSchedule
+	if err = json.Unmarshal([]byte(prev), &s); err != nil {
+		logger.Logger.Warn("websocket msg schedule json unmarshal failed", zap.String("id", id), zap.Error(err))
+		return
+	}
+
+	msg := s.Msg
+	if s.Cron != "" {
+		msg.ID = NewMsgId()
+	}
+	msg.SetTtl(time.Now().Unix(), s.Ttl)
+	_ = msg.InitMsgStatus(s.CallbackUrl)
+	if err = msg.PushWsMsgToQueue(); err != nil {
+		s.Attempts++
+		if s.Attempts < msgScheduleMaxAttempts {
+			// 写入失败时按失败次数推迟重试，推送期间被取消或修改时不覆盖
+			data, _ := json.Marshal(s)
+			if _, err = finishMsgScheduleScript.Do(rd, msgScheduleListKey, msgScheduleQueueKey, id, prev, string(data), time.Now().Unix()+s.retryDelay()); err != nil {
+				logger.Logger.Warn("delay websocket msg schedule retry failed", zap.String("id", id), zap.Error(err))
+			}
+			return
+		}
+		// 多次失败后进入死信队列，可手动重推，周期推送继续下次推送
+		logger.Logger.Warn("websocket msg schedule enqueue failed too many times", zap.String("id", id), zap.Int("attempts", s.Attempts))
+		_ = msg.SaveDeadLetter(DeadLetterEnqueueFailed)
+	}
+	s.Attempts = 0
+
+	var data []byte
+	if s.Cron != "" {
+		if err = s.next(time.Now()); err == nil {
+			data, _ = json.Marshal(s)
+		}
+	}
+	_, err = finishMsgScheduleScript.Do(rd, msgScheduleListKey, msgScheduleQueueKey, id, prev, string(data), s.DeliverAt)
+	if err != nil {
+		// 租期到后会重新推送
+		logger.Logger.Warn("finish websocket msg schedule failed", zap.String("id", id), zap.Error(err))
+		return
+	}
+
+	logger.Logger.Info("fire websocket msg schedule success", zap.String("id", s.ID), zap.Any("msg", msg))
+}
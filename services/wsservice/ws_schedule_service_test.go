@@ -0,0 +1,42 @@
+package wsservice
+
+import (
+	"go-ws/utils/errs"
+	"testing"
+	"time"
+)
+
+// 推送时消息已过期的定时推送无效
+func TestMsgScheduleNext(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 0, 30, 0, time.UTC)
+	deliverAt := now.Unix() + 3600
+	tests := []struct {
+		name     string
+		schedule MsgSchedule
+		want     error
+	}{
+		{"one shot", MsgSchedule{DeliverAt: deliverAt}, nil},
+		{"no deliver_at", MsgSchedule{}, errs.ErrMsgScheduleInvalid},
+		{"expires after deliver_at", MsgSchedule{DeliverAt: deliverAt, Msg: Msg{ExpiresAt: deliverAt + 1}}, nil},
+		{"expires before deliver_at", MsgSchedule{DeliverAt: deliverAt, Msg: Msg{ExpiresAt: deliverAt - 1}}, errs.ErrMsgScheduleInvalid},
+		{"ttl counts from deliver_at", MsgSchedule{DeliverAt: deliverAt, Ttl: 60}, nil},
+		{"cron", MsgSchedule{Cron: "* * * * *"}, nil},
+		{"cron after expires_at", MsgSchedule{Cron: "* * * * *", Msg: Msg{ExpiresAt: now.Unix() + 10}}, errs.ErrMsgScheduleInvalid},
+		{"invalid cron", MsgSchedule{Cron: "* * *"}, errs.ErrMsgScheduleInvalid},
+	}
+	for _, tt := range tests {
+		if err := tt.schedule.next(now); err != tt.want {
+			t.Errorf("%s: next error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestMsgScheduleRetryDelay(t *testing.T) {
+	want := []int64{1, 2, 4, 8, 16, 32, 60, 60}
+	for attempts, delay := range want {
+		s := MsgSchedule{Attempts: attempts}
+		if got := s.retryDelay(); got != delay {
+			t.Errorf("attempts %d retryDelay = %d, want %d", attempts, got, delay)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package wsservice
 import (
 	"github.com/gomodule/redigo/redis"
 	myredis "go-ws/databases/redis"
+	"go-ws/utils/errs"
 	"go-ws/utils/http"
 	"go-ws/utils/logger"
 	"go.uber.org/zap"
@@ -25,9 +26,37 @@ func AddWsUserConnId(onlineUserId int, userConnId string) (err error) {
 
 	logger.Logger.Info("add user connection id success", zap.Int("user_id", onlineUserId), zap.String("user_conn_id", userConnId))
 
+	// 用户重新上线时清理已关闭的旧链接ID
+	go pruneClosedUserConnIds(onlineUserId)
 	return
 }
 
+// 删除用户已关闭超过7天或数据已过期的链接ID，未关闭的链接不论建立多久都保留
+func pruneClosedUserConnIds(userId int) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	// 分值为建立时间，7天内建立的链接不可能已关闭超过7天
+	cutoff := time.Now().AddDate(0, 0, -7).Unix()
+	cacheKey := wsUserConnectionListPreCacheKey + strconv.Itoa(userId)
+	userConnIdList, err := redis.Strings(rd.Do("zRangeByScore", cacheKey, "-inf", cutoff))
+	if err != nil {
+		logger.Logger.Warn("get user old connection id failed", zap.Int("user_id", userId), zap.Error(err))
+		return
+	}
+
+	for _, userConnId := range userConnIdList {
+		w, err := GetWsUserConnInfo(userConnId)
+		if err == nil && (!w.Closed || w.DisConnectTime > cutoff) {
+			continue
+		}
+		if err != nil && err != redis.ErrNil {
+			continue
+		}
+		_ = DelWsUserConnId(userId, userConnId)
+	}
+}
+
 // 删除链接ID
 func DelWsUserConnId(onlineUserId int, userConnId string) (err error) {
 	rd := myredis.NewRedis("default_redis").Get()
@@ -42,13 +71,14 @@ func DelWsUserConnId(onlineUserId int, userConnId string) (err error) {
 	return
 }
 
-// （可多个设备登陆同一账号）获取用户链接ID列表，最多30个
+// （可多个设备登陆同一账号）获取用户链接ID列表，链接数由登录策略限制
 func GetWsUserConnIdList(userId int) (userConnIdList []string, err error) {
 	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
 
 	cacheKey := wsUserConnectionListPreCacheKey + strconv.Itoa(userId)
 
-	userConnIdList, err = redis.Strings(rd.Do("zRevRange", cacheKey, 0, 30))
+	userConnIdList, err = redis.Strings(rd.Do("zRevRange", cacheKey, 0, -1))
 	if err != nil {
 		logger.Logger.Warn("get websocket client list failed", zap.Int("user_id", userId), zap.String("cacheKey", cacheKey), zap.Error(err))
 		return
@@ -56,25 +86,37 @@ func GetWsUserConnIdList(userId int) (userConnIdList []string, err error) {
 	return
 }
 
-// 删除本机的用户链接
-func DelLocalUserConn(userConnId string) (err error) {
-	if w, ok := AllWsUserConnInfos[userConnId]; ok {
-		err = w.wsConnection.Close()
-		if err != nil {
-			logger.Logger.Warn("del websocket user connection failed", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.Error(err))
-			return
-		}
-		delete(AllWsUserConnInfos, userConnId)
+// 删除本机的用户链接，由管理协程发送关闭原因并清理数据
+func DelLocalUserConn(userConnId string, reason errs.CloseReason) (err error) {
+	if w, ok := GetLocalUserConn(userConnId); ok {
+		w.Close(reason)
 	}
 
 	return
 }
 
-// 删除其他服务器的用户链接
-func DelOtherServerUserConn(node, userConnId string) (err error) {
+// 关闭用户链接，由链接所在的实例发送关闭原因
+// 平滑重启时新旧进程的服务器地址相同，按实例ID判断链接是否在本进程
+func CloseUserConn(w *WsUserConnInfo, reason errs.CloseReason) (err error) {
+	if _, ok := GetLocalUserConn(w.ID); ok || w.Instance == LocalInstance() {
+		return DelLocalUserConn(w.ID, reason)
+	}
+	if w.Node == LocalNode() {
+		// 链接在同一地址的旧进程上，旧进程已不再接收请求，转发会回到本进程
+		// 吊销重连token，旧进程下线关闭链接后客户端不能接管该链接
+		logger.Logger.Warn("websocket conn belongs to another local instance", zap.Int("user_id", w.UID), zap.String("user_conn_id", w.ID), zap.String("instance", w.Instance))
+		return w.revokeResumeToken()
+	}
+	return DelOtherServerUserConn(w.Node, w.UID, w.ID, reason)
+}
+
+// 删除其他服务器的用户链接，关闭原因通过状态码传递
+func DelOtherServerUserConn(node string, userId int, userConnId string, reason errs.CloseReason) (err error) {
 	reqUrl := "http://" + node + "/ws/connection/close"
 	var data = url.Values{}
+	data.Add("uid", strconv.Itoa(userId))
 	data.Add("cid", userConnId)
+	data.Add("code", strconv.Itoa(reason.Code))
 	err = http.Post(reqUrl, data)
 	if err != nil {
 		logger.Logger.Warn("delete websocket connection in other server failed", zap.String("node", node), zap.String("user_conn_id", userConnId), zap.Error(err))
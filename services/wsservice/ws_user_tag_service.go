@@ -0,0 +1,82 @@
+package wsservice
+
+import (
+	"github.com/gomodule/redigo/redis"
+	myredis "go-ws/databases/redis"
+	"go-ws/utils/logger"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+const (
+	// 标签下的用户ID列表
+	wsUserTagPreCacheKey = "ws_user_tag:"
+	// 用户的标签列表
+	wsUserTagListPreCacheKey = "ws_user_tag_list:"
+)
+
+// 给用户添加标签
+func AddUserTags(userId int, tags []string) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	rd.Send("MULTI")
+	for _, tag := range tags {
+		rd.Send("sAdd", wsUserTagPreCacheKey+tag, userId)
+	}
+	rd.Send("sAdd", redis.Args{}.Add(wsUserTagListPreCacheKey+strconv.Itoa(userId)).AddFlat(tags)...)
+	_, err = rd.Do("EXEC")
+	if err != nil {
+		logger.Logger.Warn("add websocket user tags failed", zap.Int("user_id", userId), zap.Strings("tags", tags), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 删除用户的标签
+func DelUserTags(userId int, tags []string) (err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	rd.Send("MULTI")
+	for _, tag := range tags {
+		rd.Send("sRem", wsUserTagPreCacheKey+tag, userId)
+	}
+	rd.Send("sRem", redis.Args{}.Add(wsUserTagListPreCacheKey+strconv.Itoa(userId)).AddFlat(tags)...)
+	_, err = rd.Do("EXEC")
+	if err != nil {
+		logger.Logger.Warn("del websocket user tags failed", zap.Int("user_id", userId), zap.Strings("tags", tags), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 获取用户的标签
+func GetUserTags(userId int) (tags []string, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	tags, err = redis.Strings(rd.Do("sMembers", wsUserTagListPreCacheKey+strconv.Itoa(userId)))
+	if err != nil {
+		logger.Logger.Warn("get websocket user tags failed", zap.Int("user_id", userId), zap.Error(err))
+		return
+	}
+	return
+}
+
+// 获取同时拥有所有标签的用户ID
+func GetTagUserIdList(tags []string) (userIdList []int, err error) {
+	rd := myredis.NewRedis("default_redis").Get()
+	defer rd.Close()
+
+	args := redis.Args{}
+	for _, tag := range tags {
+		args = args.Add(wsUserTagPreCacheKey + tag)
+	}
+	userIdList, err = redis.Ints(rd.Do("sInter", args...))
+	if err != nil {
+		logger.Logger.Warn("get websocket tag user list failed", zap.Strings("tags", tags), zap.Error(err))
+		return
+	}
+	return
+}
@@ -0,0 +1,58 @@
+package codec
+
+import (
+	"sync"
+)
+
+// 消息编解码接口，链接建立时通过Sec-WebSocket-Protocol协商使用哪种编码
+type Codec interface {
+	// 协议名，与Sec-WebSocket-Protocol的值一致
+	Name() string
+	// 使用的websocket帧类型，websocket.TextMessage或websocket.BinaryMessage
+	MessageType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	mu     sync.RWMutex
+	codecs = make(map[string]Codec)
+	// 协商时服务端的优先顺序
+	names []string
+)
+
+func init() {
+	Register(MsgpackCodec{})
+	Register(ProtobufCodec{})
+	Register(JsonCodec{})
+}
+
+// 注册编解码，注册越早协商时优先级越高
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := codecs[c.Name()]; !ok {
+		names = append(names, c.Name())
+	}
+	codecs[c.Name()] = c
+}
+
+// 根据协议名获取编解码
+func Get(name string) (c Codec, ok bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok = codecs[name]
+	return
+}
+
+// 默认编解码，客户端没有指定子协议时使用json
+func Default() Codec {
+	return JsonCodec{}
+}
+
+// 所有支持的协议名，用于websocket子协议协商
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]string(nil), names...)
+}
@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+type testMsg struct {
+	ID      string `json:"id"`
+	UID     int64  `json:"uid"`
+	Content string `json:"content"`
+	Seq     int64  `json:"seq,omitempty"`
+}
+
+func (m testMsg) MarshalProto() ([]byte, error) {
+	var w ProtoWriter
+	w.String(1, m.ID)
+	w.Int(2, m.UID)
+	w.String(3, m.Content)
+	w.Int(4, m.Seq)
+	return w.Result(), nil
+}
+
+func (m *testMsg) UnmarshalProto(data []byte) error {
+	r := NewProtoReader(data)
+	for {
+		field, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			m.ID = r.String()
+		case 2:
+			m.UID = r.Int()
+		case 3:
+			m.Content = r.String()
+		case 4:
+			m.Seq = r.Int()
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	msgs := []testMsg{
+		{ID: "1", UID: 100, Content: "hello", Seq: 1},
+		{ID: "2", UID: 1 << 40, Content: "你好", Seq: -1},
+		{},
+	}
+	for _, name := range Names() {
+		c, _ := Get(name)
+		for _, msg := range msgs {
+			data, err := c.Marshal(msg)
+			if err != nil {
+				t.Fatalf("%s marshal %+v error: %v", name, msg, err)
+			}
+			var got testMsg
+			if err = c.Unmarshal(data, &got); err != nil {
+				t.Fatalf("%s unmarshal %+v error: %v", name, msg, err)
+			}
+			if !reflect.DeepEqual(got, msg) {
+				t.Errorf("%s round trip = %+v, want %+v", name, got, msg)
+			}
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	want := []string{"msgpack", "protobuf", "json"}
+	if got := Names(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Names() = %v, want %v", got, want)
+	}
+	if Default().Name() != "json" {
+		t.Fatalf("Default() = %s, want json", Default().Name())
+	}
+}
+
+func TestProtobufNotSupported(t *testing.T) {
+	c := ProtobufCodec{}
+	if _, err := c.Marshal(map[string]string{"id": "1"}); err != ErrNotProtoMessage {
+		t.Fatalf("marshal error = %v, want ErrNotProtoMessage", err)
+	}
+	var v map[string]string
+	if err := c.Unmarshal([]byte{}, &v); err != ErrNotProtoMessage {
+		t.Fatalf("unmarshal error = %v, want ErrNotProtoMessage", err)
+	}
+}
+
+// 未知字段跳过，截断的数据返回错误
+func TestProtoReader(t *testing.T) {
+	var w ProtoWriter
+	w.String(1, "id")
+	w.Int(9, 7)
+	w.String(3, "content")
+	data := w.Result()
+
+	var got testMsg
+	if err := got.UnmarshalProto(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "id" || got.Content != "content" {
+		t.Fatalf("got %+v, want id and content", got)
+	}
+
+	if err := got.UnmarshalProto(data[:len(data)-1]); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,26 @@
+package codec
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// json编解码，使用文本帧
+type JsonCodec struct{}
+
+func (JsonCodec) Name() string {
+	return "json"
+}
+
+func (JsonCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (JsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
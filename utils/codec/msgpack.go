@@ -0,0 +1,39 @@
+package codec
+
+import (
+	"reflect"
+
+	"github.com/gorilla/websocket"
+	ugorji "github.com/ugorji/go/codec"
+)
+
+var msgpackHandle = newMsgpackHandle()
+
+func newMsgpackHandle() *ugorji.MsgpackHandle {
+	h := &ugorji.MsgpackHandle{}
+	// 字符串解码为string而不是[]byte
+	h.RawToString = true
+	h.WriteExt = true
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}
+
+// MessagePack编解码，使用二进制帧，字段名沿用json tag
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MsgpackCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (MsgpackCodec) Marshal(v interface{}) (data []byte, err error) {
+	err = ugorji.NewEncoderBytes(&data, msgpackHandle).Encode(v)
+	return
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return ugorji.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
@@ -0,0 +1,166 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+// protobuf wire type
+const (
+	WireVarint  = 0
+	WireFixed64 = 1
+	WireBytes   = 2
+	WireFixed32 = 5
+)
+
+var ErrNotProtoMessage = errors.New("value does not support protobuf encoding")
+
+// 业务消息实现以下接口以支持protobuf编解码
+type ProtoMarshaler interface {
+	MarshalProto() ([]byte, error)
+}
+
+type ProtoUnmarshaler interface {
+	UnmarshalProto(data []byte) error
+}
+
+// Protobuf编解码，使用二进制帧，消息按ProtoWriter和ProtoReader手写编解码，字段定义见ws.proto
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (ProtobufCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(ProtoMarshaler); ok {
+		return m.MarshalProto()
+	}
+	return nil, ErrNotProtoMessage
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(ProtoUnmarshaler); ok {
+		return m.UnmarshalProto(data)
+	}
+	return ErrNotProtoMessage
+}
+
+// protobuf编码
+type ProtoWriter struct {
+	buf []byte
+}
+
+func (w *ProtoWriter) key(field, wireType int) {
+	w.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (w *ProtoWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf = append(w.buf, b[:n]...)
+}
+
+// 写入int字段，零值不写入
+func (w *ProtoWriter) Int(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	w.key(field, WireVarint)
+	w.varint(uint64(v))
+}
+
+// 写入string字段，空值不写入
+func (w *ProtoWriter) String(field int, v string) {
+	if v == "" {
+		return
+	}
+	w.key(field, WireBytes)
+	w.varint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// 编码结果
+func (w *ProtoWriter) Result() []byte {
+	return w.buf
+}
+
+// protobuf解码
+type ProtoReader struct {
+	buf []byte
+	// 当前字段的值
+	varint uint64
+	bytes  []byte
+}
+
+func NewProtoReader(data []byte) *ProtoReader {
+	return &ProtoReader{buf: data}
+}
+
+func (r *ProtoReader) uvarint() (v uint64, err error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.buf = r.buf[n:]
+	return
+}
+
+func (r *ProtoReader) take(n int) (b []byte, err error) {
+	if n < 0 || n > len(r.buf) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b, r.buf = r.buf[:n], r.buf[n:]
+	return
+}
+
+// 读取下一个字段，返回字段编号，读完时返回io.EOF，未知的wire type返回错误
+func (r *ProtoReader) Next() (field int, err error) {
+	if len(r.buf) == 0 {
+		return 0, io.EOF
+	}
+	var key uint64
+	if key, err = r.uvarint(); err != nil {
+		return
+	}
+	field = int(key >> 3)
+	r.varint, r.bytes = 0, nil
+	switch key & 7 {
+	case WireVarint:
+		r.varint, err = r.uvarint()
+	case WireFixed64:
+		var b []byte
+		if b, err = r.take(8); err == nil {
+			r.varint = binary.LittleEndian.Uint64(b)
+		}
+	case WireBytes:
+		var n uint64
+		if n, err = r.uvarint(); err == nil {
+			r.bytes, err = r.take(int(n))
+		}
+	case WireFixed32:
+		var b []byte
+		if b, err = r.take(4); err == nil {
+			r.varint = uint64(binary.LittleEndian.Uint32(b))
+		}
+	default:
+		err = errors.New("unsupported protobuf wire type")
+	}
+	return
+}
+
+// 当前字段的int值
+func (r *ProtoReader) Int() int64 {
+	return int64(r.varint)
+}
+
+// 当前字段的string值
+func (r *ProtoReader) String() string {
+	return string(r.bytes)
+}
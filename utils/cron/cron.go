@@ -0,0 +1,119 @@
+package cron
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSpec = errors.New("invalid cron spec")
+
+// 每个字段的取值范围：分 时 日 月 周，周日可以写作0或7
+var bounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// 解析后的cron表达式，每个字段为允许的取值集合
+type Schedule struct {
+	fields [5]map[int]bool
+	// 日和周都不为*时满足其一即可
+	domStar, dowStar bool
+}
+
+// 解析5段式cron表达式：分 时 日 月 周，支持 *、*/n、a、a/n、a-b、a-b/n、a,b
+func Parse(spec string) (s Schedule, err error) {
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return s, ErrInvalidSpec
+	}
+
+	for i, part := range parts {
+		if s.fields[i], err = parseField(part, bounds[i][0], bounds[i][1]); err != nil {
+			return
+		}
+	}
+	if s.fields[4][7] {
+		delete(s.fields[4], 7)
+		s.fields[4][0] = true
+	}
+	s.domStar = parts[2] == "*"
+	s.dowStar = parts[4] == "*"
+	return
+}
+
+// 解析单个字段
+func parseField(field string, min, max int) (values map[int]bool, err error) {
+	values = make(map[int]bool)
+	for _, item := range strings.Split(field, ",") {
+		step, hasStep := 1, false
+		if i := strings.Index(item, "/"); i >= 0 {
+			hasStep = true
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return nil, ErrInvalidSpec
+			}
+			item = item[:i]
+		}
+
+		start, end := min, max
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			r := strings.SplitN(item, "-", 2)
+			if start, err = strconv.Atoi(r[0]); err != nil {
+				return nil, ErrInvalidSpec
+			}
+			if end, err = strconv.Atoi(r[1]); err != nil {
+				return nil, ErrInvalidSpec
+			}
+		default:
+			if start, err = strconv.Atoi(item); err != nil {
+				return nil, ErrInvalidSpec
+			}
+			// a/n表示从a开始到最大值每隔n
+			end = start
+			if hasStep {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, ErrInvalidSpec
+		}
+
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+	return
+}
+
+// 计算t之后的下一次执行时间，精确到分钟，五年内没有匹配时返回零值
+// 按t所在时区的本地时间取整，不能用Truncate，Truncate按UTC取整，在半小时时区会错位
+func (s Schedule) Next(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, t.Location()).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if !s.fields[3][int(t.Month())] || !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).AddDate(0, 0, 1)
+			continue
+		}
+		if !s.fields[1][t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location()).Add(time.Hour)
+			continue
+		}
+		if !s.fields[0][t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// 日和周的匹配，与标准cron一致：两者都有限制时满足其一即可
+func (s Schedule) matchDay(t time.Time) bool {
+	dom := s.fields[2][t.Day()]
+	dow := s.fields[4][int(t.Weekday())]
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
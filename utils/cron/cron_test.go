@@ -0,0 +1,121 @@
+package cron
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func fieldValues(values map[int]bool) []int {
+	list := make([]int, 0, len(values))
+	for v := range values {
+		list = append(list, v)
+	}
+	sort.Ints(list)
+	return list
+}
+
+func TestParseField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+	}{
+		{"*", 0, 6, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"5", 0, 59, []int{5}},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}},
+		{"5/15", 0, 59, []int{5, 20, 35, 50}},
+		{"10-20/5", 0, 59, []int{10, 15, 20}},
+		{"1,3,5", 0, 59, []int{1, 3, 5}},
+		{"1-3,10", 1, 31, []int{1, 2, 3, 10}},
+	}
+	for _, tt := range tests {
+		values, err := parseField(tt.field, tt.min, tt.max)
+		if err != nil {
+			t.Fatalf("parseField(%q) error: %v", tt.field, err)
+		}
+		if got := fieldValues(values); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseField(%q) = %v, want %v", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"0 9 * * 1-5", false},
+		{"0 9 * * 7", false},
+		{"0 9 * * 5-7", false},
+		{"* * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"*/0 * * * *", true},
+		{"5-1 * * * *", true},
+		{"a * * * *", true},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseSunday(t *testing.T) {
+	s, err := Parse("0 0 * * 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fieldValues(s.fields[4]); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("dow = %v, want [0]", got)
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := time.UTC
+	// 印度时区为UTC+5:30
+	ist := time.FixedZone("IST", 5*3600+1800)
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 1, 10, 0, 30, 0, utc), time.Date(2024, 1, 1, 10, 1, 0, 0, utc)},
+		{"5/15 * * * *", time.Date(2024, 1, 1, 10, 6, 0, 0, utc), time.Date(2024, 1, 1, 10, 20, 0, 0, utc)},
+		{"0 9 * * *", time.Date(2024, 1, 1, 9, 0, 0, 0, utc), time.Date(2024, 1, 2, 9, 0, 0, 0, utc)},
+		{"30 8 1 * *", time.Date(2024, 1, 15, 0, 0, 0, 0, utc), time.Date(2024, 2, 1, 8, 30, 0, 0, utc)},
+		// 2024-01-07是周日
+		{"0 0 * * 7", time.Date(2024, 1, 1, 0, 0, 0, 0, utc), time.Date(2024, 1, 7, 0, 0, 0, 0, utc)},
+		// 日和周都有限制时满足其一即可，2024-01-05是周五
+		{"0 0 10 * 5", time.Date(2024, 1, 1, 0, 0, 0, 0, utc), time.Date(2024, 1, 5, 0, 0, 0, 0, utc)},
+		{"0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, utc), time.Date(2028, 2, 29, 0, 0, 0, 0, utc)},
+		{"0 9 * * *", time.Date(2024, 1, 1, 8, 45, 0, 0, ist), time.Date(2024, 1, 1, 9, 0, 0, 0, ist)},
+		{"15 * * * *", time.Date(2024, 1, 1, 8, 45, 0, 0, ist), time.Date(2024, 1, 1, 9, 15, 0, 0, ist)},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q) error: %v", tt.spec, err)
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("Next(%q, %v) = %v, want %v", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestNextNoMatch(t *testing.T) {
+	s, err := Parse("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Fatalf("Next = %v, want zero", got)
+	}
+}
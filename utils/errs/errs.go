@@ -41,5 +41,66 @@ var (
 	ErrWebSocketHaveOtherConnection = StandardError{20002, "websocket already connected in elsewhere"}
 	ErrWebSocketConnectionIDIsNil      = StandardError{20003, "websocket connection id is nil"}
 	ErrWebSocketMessageIsNone       = StandardError{20004, "websocket send message is null"}
+	ErrWebSocketSendBufferFull      = StandardError{20005, "websocket send buffer is full"}
+	ErrWebSocketConnectionClosed    = StandardError{20006, "websocket connection is closed"}
+	ErrWebSocketCloseCodeInvalid    = StandardError{20007, "websocket close code is invalid"}
+	ErrWebSocketResumeTokenInvalid  = StandardError{20008, "websocket resume token is invalid or expired"}
+	ErrWebSocketServerDraining      = StandardError{20009, "websocket server is draining, reconnect elsewhere"}
+	ErrDeadLetterNotFound           = StandardError{20010, "dead letter msg not found"}
+	ErrMsgStatusNotFound            = StandardError{20011, "msg status not found or expired"}
+	ErrMsgExpired                   = StandardError{20012, "msg is expired"}
+	ErrMsgScheduleNotFound          = StandardError{20013, "msg schedule not found"}
+	ErrMsgScheduleInvalid           = StandardError{20014, "msg schedule cron or deliver_at is invalid"}
+	ErrBulkJobNotFound              = StandardError{20015, "bulk msg job not found or expired"}
+	ErrMsgSendInProgress            = StandardError{20016, "msg with the same idempotency key is being sent"}
+	ErrMsgNotFound                  = StandardError{20017, "msg not found or already expired"}
+	ErrMsgQueueFull                 = StandardError{20018, "user msg queue is full"}
+	ErrCallbackUrlInvalid           = StandardError{20019, "callback url is invalid or host not allowed"}
 
 )
+
+// websocket关闭原因，Code为close frame的状态码，4000-4999为业务自定义
+type CloseReason struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// WithReason is method to set close reason text
+func (r CloseReason) WithReason(reason string) CloseReason {
+	r.Reason = r.Reason + ": " + reason
+	return r
+}
+
+var (
+	CloseNormal             = CloseReason{1000, "normal closure"}
+	CloseServerShutdown     = CloseReason{1001, "server shutting down"}
+	CloseInternalError      = CloseReason{1011, "internal server error"}
+	CloseReconnectElsewhere = CloseReason{1012, "reconnect elsewhere"}
+	CloseConnectionLost     = CloseReason{4000, "connection lost"}
+	CloseKickedByAdmin      = CloseReason{4001, "kicked by admin"}
+	CloseReplacedByNewLogin = CloseReason{4002, "replaced by new login"}
+	CloseAuthExpired        = CloseReason{4003, "auth expired"}
+	CloseSlowConsumer       = CloseReason{4004, "slow consumer"}
+	CloseSessionResumed     = CloseReason{4005, "session resumed by new connection"}
+	CloseMaxSessions        = CloseReason{4006, "max sessions exceeded by new login"}
+	ClosePlatformReplaced   = CloseReason{4007, "replaced by new login on the same platform"}
+	CloseLoginRejected      = CloseReason{4008, "login rejected by session limit"}
+
+	closeReasons = map[int]CloseReason{}
+)
+
+func init() {
+	for _, r := range []CloseReason{
+		CloseNormal, CloseServerShutdown, CloseInternalError, CloseReconnectElsewhere, CloseConnectionLost,
+		CloseKickedByAdmin, CloseReplacedByNewLogin, CloseAuthExpired, CloseSlowConsumer,
+		CloseSessionResumed, CloseMaxSessions, ClosePlatformReplaced, CloseLoginRejected,
+	} {
+		closeReasons[r.Code] = r
+	}
+}
+
+// 根据状态码获取关闭原因，用于服务间传递
+func GetCloseReason(code int) (r CloseReason, ok bool) {
+	r, ok = closeReasons[code]
+	return
+}
@@ -1,12 +1,15 @@
 package http
 
 import (
+	"go-ws/config"
 	"go-ws/utils/errs"
 	"go-ws/utils/logger"
 	"go.uber.org/zap"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/buger/jsonparser"
 )
@@ -45,3 +48,38 @@ func Post(url string, data url.Values) (err error) {
 
 
 
+
+var (
+	notifyClient     *http.Client
+	notifyClientOnce sync.Once
+)
+
+// 回调通知共用的http客户端，设置超时避免回调地址无响应时协程堆积，不跟随重定向，避免绕过域名限制
+func getNotifyClient() *http.Client {
+	notifyClientOnce.Do(func() {
+		notifyClient = &http.Client{
+			Timeout: time.Duration(config.Settings.Websocket.CallbackTimeout) * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	})
+	return notifyClient
+}
+
+// 发送回调通知，只判断http状态码，不解析返回内容
+func Notify(url string, data url.Values) (err error) {
+	var rsp *http.Response
+	rsp, err = getNotifyClient().PostForm(url, data)
+	if err != nil {
+		logger.Logger.Warn("notify callback request failed", zap.String("url", url), zap.Any("data", data), zap.Error(err))
+		return
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		logger.Logger.Warn("notify callback request failed", zap.String("url", url), zap.Any("data", data), zap.Int("status", rsp.StatusCode))
+		return errs.ErrRequestUrlFailed
+	}
+	return nil
+}
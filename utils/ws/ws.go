@@ -3,9 +3,15 @@ package ws
 import (
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"go-ws/config"
+	"go-ws/utils/codec"
+	"go-ws/utils/errs"
 	"go-ws/utils/logger"
 	"go.uber.org/zap"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,7 +20,8 @@ import (
 type WsConnection struct {
 	ID string
 	Socket *websocket.Conn
-	connection bool
+	// 握手时协商的消息编解码
+	Codec codec.Codec
 	mu sync.Mutex
 }
 
@@ -22,71 +29,135 @@ type WsConnection struct {
 func (w *WsConnection) Send(v []byte) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	return w.Socket.WriteMessage(websocket.TextMessage, v)
+	// 设置写超时，避免慢客户端一直阻塞写协程
+	_ = w.Socket.SetWriteDeadline(time.Now().Add(time.Duration(config.Settings.Websocket.WriteWait) * time.Second))
+	// 小消息压缩收益低，只压缩达到阈值的消息，未协商压缩时不生效
+	if config.Settings.Websocket.EnableCompression {
+		w.Socket.EnableWriteCompression(len(v) >= config.Settings.Websocket.CompressionThreshold)
+	}
+	return w.Socket.WriteMessage(w.Codec.MessageType(), v)
 }
 
 // 关闭链接
 func (w *WsConnection) Close() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	w.connection = false
 	return w.Socket.Close()
 }
 
-// 检查链接是否中断
-func (w *WsConnection) ping() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	return w.Socket.WriteMessage(websocket.PingMessage, nil)
+// 发送close frame告知客户端关闭原因后关闭链接
+func (w *WsConnection) CloseWithReason(reason errs.CloseReason) error {
+	deadline := time.Now().Add(time.Duration(config.Settings.Websocket.WriteWait) * time.Second)
+	msg := websocket.FormatCloseMessage(reason.Code, reason.Reason)
+	if err := w.Socket.WriteControl(websocket.CloseMessage, msg, deadline); err != nil && err != websocket.ErrCloseSent {
+		logger.Logger.Warn("write websocket close message failed", zap.String("conn_id", w.ID), zap.Any("reason", reason), zap.Error(err))
+	}
+	return w.Socket.Close()
+}
+
+// 发送ping，WriteControl可以和其他写操作并发调用
+func (w *WsConnection) Ping() error {
+	deadline := time.Now().Add(time.Duration(config.Settings.Websocket.WriteWait) * time.Second)
+	return w.Socket.WriteControl(websocket.PingMessage, nil, deadline)
 }
 
-// 返回连接是否中断
-func (w *WsConnection) IsConnect() bool {
-	if w.connection == true {
-		if err := w.ping(); err != nil {
-			w.connection = false
+// 设置读超时，每次收到pong时延长，超时未收到pong时Read返回错误
+func (w *WsConnection) SetPongWait(pongWait time.Duration) {
+	_ = w.Socket.SetReadDeadline(time.Now().Add(pongWait))
+	w.Socket.SetPongHandler(func(string) error {
+		return w.Socket.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
+
+var (
+	upgrader     *websocket.Upgrader
+	upgraderOnce sync.Once
+)
+
+// 根据配置创建upgrader，只创建一次
+func getUpgrader() *websocket.Upgrader {
+	upgraderOnce.Do(func() {
+		cfg := config.Settings.Websocket
+		upgrader = &websocket.Upgrader{
+			ReadBufferSize:    cfg.ReadBufferSize,
+			WriteBufferSize:   cfg.WriteBufferSize,
+			HandshakeTimeout:  time.Duration(cfg.HandshakeTimeout) * time.Second,
+			EnableCompression: cfg.EnableCompression,
+			// 通过Sec-WebSocket-Protocol协商消息编码
+			Subprotocols: codec.Names(),
 		}
-	}
-	return w.connection
+		// 没有配置Origin白名单时使用gorilla默认的同源检查
+		if len(cfg.AllowedOrigins) > 0 {
+			upgrader.CheckOrigin = checkOrigin(cfg.AllowedOrigins)
+		}
+	})
+	return upgrader
 }
 
-// 创建链接
-func CreateWsConnection(w http.ResponseWriter, r *http.Request) (wsConnction WsConnection, err error) {
-	var upgrader = websocket.Upgrader{
-		ReadBufferSize:   1024,
-		WriteBufferSize:  1024,
-		HandshakeTimeout: time.Second * 5,
-		CheckOrigin: func(r *http.Request) bool {
+// Origin白名单检查，规则包含"://"时匹配完整的Origin，否则只匹配host
+func checkOrigin(patterns []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		// 非浏览器客户端不带Origin
+		if origin == "" {
 			return true
-		},
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		for _, pattern := range patterns {
+			target := strings.ToLower(u.Host)
+			if strings.Contains(pattern, "://") {
+				target = strings.ToLower(origin)
+			}
+			if ok, _ := path.Match(strings.ToLower(pattern), target); ok {
+				return true
+			}
+		}
+		logger.Logger.Warn("websocket origin not allowed", zap.String("origin", origin))
+		return false
 	}
+}
 
-	var id = uuid.New().String()
-	c, err := upgrader.Upgrade(w, r, http.Header{"uid": {id}})
+// 创建链接，id为空时生成新的链接ID，header为握手响应附带的头信息
+func CreateWsConnection(w http.ResponseWriter, r *http.Request, id string, header http.Header) (wsConnction WsConnection, err error) {
+	if id == "" {
+		id = uuid.New().String()
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	header["uid"] = []string{id}
+	c, err := getUpgrader().Upgrade(w, r, header)
 	if err != nil {
 		logger.Logger.Error("CreateWsConnection error", zap.Error(err))
 		return
 	}
+	// 限制客户端单条消息长度，超出时读取返回错误并断开链接
+	c.SetReadLimit(config.Settings.Websocket.MaxMessageSize)
+
+	// 客户端没有指定子协议时使用默认的json编码
+	msgCodec, ok := codec.Get(c.Subprotocol())
+	if !ok {
+		msgCodec = codec.Default()
+	}
 
 	wsConnction = WsConnection{
 		ID:      id,
 		Socket:   c,
-		connection: true,
+		Codec:    msgCodec,
 	}
 
 	return
 }
 
-// 读取链接消息
-func (w *WsConnection) Read() (content string, err error) {
-	var message []byte
+// 读取链接消息，文本帧和二进制帧都交给协商的编解码处理
+func (w *WsConnection) Read() (message []byte, err error) {
 	_, message, err = w.Socket.ReadMessage()
 	if err != nil {
 		logger.Logger.Error("WsConnection Read message error", zap.Error(err))
 		return
 	}
 
-	content = string(message)
 	return
 }
 